@@ -1,5 +1,5 @@
 module github.com/pavelverigo/natalie
 
-go 1.19
+go 1.20
 
-require github.com/jackpal/gateway v1.0.7 // indirect
+require github.com/jackpal/gateway v1.0.7
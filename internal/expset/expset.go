@@ -0,0 +1,66 @@
+package expset
+
+import "time"
+
+// ExpSet is set with bounded size, where keys expire after ttl
+type ExpSet[T comparable] struct {
+	m     map[T]time.Time
+	queue []entry[T] // in insertion order, oldest first
+	cap   int
+	ttl   time.Duration
+}
+
+type entry[T comparable] struct {
+	key  T
+	time time.Time
+}
+
+func New[T comparable](cap int, ttl time.Duration) *ExpSet[T] {
+	m := make(map[T]time.Time, cap)
+
+	return &ExpSet[T]{
+		m:     m,
+		queue: make([]entry[T], 0, cap),
+		cap:   cap,
+		ttl:   ttl,
+	}
+}
+
+// Add key, returns false if key already present
+func (s *ExpSet[T]) Add(key T, now time.Time) bool {
+	s.expire(now)
+	if _, ok := s.m[key]; ok {
+		return false
+	}
+	if len(s.m) >= s.cap {
+		s.pop()
+	}
+	s.m[key] = now
+	s.queue = append(s.queue, entry[T]{key: key, time: now})
+	return true
+}
+
+func (s *ExpSet[T]) Contains(key T, now time.Time) bool {
+	s.expire(now)
+	_, ok := s.m[key]
+	return ok
+}
+
+func (s *ExpSet[T]) Len() int {
+	return len(s.m)
+}
+
+func (s *ExpSet[T]) expire(now time.Time) {
+	for len(s.queue) > 0 && now.Sub(s.queue[0].time) > s.ttl {
+		s.pop()
+	}
+}
+
+func (s *ExpSet[T]) pop() {
+	delete(s.m, s.queue[0].key)
+	s.queue[0] = entry[T]{}
+	s.queue = s.queue[1:]
+	if len(s.queue) == 0 {
+		s.queue = s.queue[:0:0] // release backing array
+	}
+}
@@ -0,0 +1,88 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// rfc 6886
+const (
+	natpmpVersion    = 0
+	natpmpOpAddr     = 0
+	natpmpOpMapUDP   = 1
+	natpmpRespFlag   = 128
+	natpmpUnsuppVers = 1
+)
+
+// prev is mapping being renewed or deleted, nil for new one
+func mapNATPMP(ctx context.Context, gateway string, internalPort int, lifetime time.Duration, prev *Mapping) (*Mapping, error) {
+	var ip net.IP
+	if lifetime > 0 {
+		var err error
+		ip, err = natpmpExternalIP(ctx, gateway)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	if prev != nil && lifetime > 0 {
+		binary.BigEndian.PutUint16(req[6:], uint16(prev.External.Port)) // same external port on renew
+	} else if lifetime > 0 {
+		binary.BigEndian.PutUint16(req[6:], uint16(internalPort)) // suggested external port
+	}
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := exchange(ctx, gateway, func(net.IP) []byte { return req }, func(resp []byte) bool {
+		return len(resp) >= 16 && resp[1] == natpmpRespFlag+natpmpOpMapUDP &&
+			binary.BigEndian.Uint16(resp[8:]) == uint16(internalPort)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(resp); err != nil {
+		return nil, err
+	}
+
+	return &Mapping{
+		Protocol:     NATPMP,
+		Gateway:      gateway,
+		InternalPort: internalPort,
+		External: &net.UDPAddr{
+			IP:   ip,
+			Port: int(binary.BigEndian.Uint16(resp[10:])),
+		},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}, nil
+}
+
+func natpmpExternalIP(ctx context.Context, gateway string) (net.IP, error) {
+	req := []byte{natpmpVersion, natpmpOpAddr}
+	resp, err := exchange(ctx, gateway, func(net.IP) []byte { return req }, func(resp []byte) bool {
+		return len(resp) >= 12 && resp[1] == natpmpRespFlag+natpmpOpAddr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(resp); err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func natpmpResult(resp []byte) error {
+	code := binary.BigEndian.Uint16(resp[2:])
+	switch {
+	case code == 0:
+		return nil
+	case code == natpmpUnsuppVers:
+		return ErrUnsupported
+	default:
+		return &ResultError{Protocol: NATPMP, Code: int(code)}
+	}
+}
@@ -0,0 +1,92 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// rfc 6887
+const (
+	pcpVersion      = 2
+	pcpOpMap        = 1
+	pcpRespFlag     = 128
+	pcpUnsuppVers   = 1
+	pcpProtoUDP     = 17
+	pcpHeaderSize   = 24
+	pcpMapSize      = 36
+	pcpResponseSize = pcpHeaderSize + pcpMapSize
+)
+
+// prev is mapping being renewed or deleted, nil for new one
+func mapPCP(ctx context.Context, gateway string, internalPort int, lifetime time.Duration, prev *Mapping) (*Mapping, error) {
+	var nonce [12]byte
+	if prev != nil {
+		nonce = prev.nonce
+	} else if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	// client address is known only after socket is bound
+	build := func(client net.IP) []byte {
+		req := make([]byte, pcpHeaderSize+pcpMapSize)
+		req[0] = pcpVersion
+		req[1] = pcpOpMap
+		binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+		copy(req[8:24], client.To16())
+
+		m := req[pcpHeaderSize:]
+		copy(m[0:12], nonce[:])
+		m[12] = pcpProtoUDP
+		binary.BigEndian.PutUint16(m[16:], uint16(internalPort))
+		if prev != nil && lifetime > 0 {
+			// ask for same external address on renew
+			binary.BigEndian.PutUint16(m[18:], uint16(prev.External.Port))
+			copy(m[20:36], prev.External.IP.To16())
+		} else if lifetime > 0 {
+			binary.BigEndian.PutUint16(m[18:], uint16(internalPort))
+		}
+		return req
+	}
+
+	resp, err := exchange(ctx, gateway, build, func(resp []byte) bool {
+		if len(resp) < 4 || resp[1] != pcpRespFlag+pcpOpMap {
+			return false
+		}
+		// error responses may be short or sent by nat-pmp only server
+		return resp[3] != 0 || (len(resp) >= pcpResponseSize && bytes.Equal(resp[pcpHeaderSize:pcpHeaderSize+12], nonce[:]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, ErrUnsupported
+	}
+	switch code := resp[3]; {
+	case code == pcpUnsuppVers:
+		return nil, ErrUnsupported
+	case code != 0:
+		return nil, &ResultError{Protocol: PCP, Code: int(code)}
+	}
+
+	rm := resp[pcpHeaderSize:]
+	ip := make(net.IP, 16)
+	copy(ip, rm[20:36])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &Mapping{
+		Protocol:     PCP,
+		Gateway:      gateway,
+		InternalPort: internalPort,
+		External: &net.UDPAddr{
+			IP:   ip,
+			Port: int(binary.BigEndian.Uint16(rm[18:])),
+		},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second,
+		nonce:    nonce,
+	}, nil
+}
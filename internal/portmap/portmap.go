@@ -0,0 +1,151 @@
+// Package portmap asks gateway for external udp port mapping, with PCP or NAT-PMP
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const DefaultPort = 5351 // of both PCP and NAT-PMP server on gateway
+
+const (
+	initialTimeout = 250 * time.Millisecond // doubled on every retry
+	maxAttempts    = 4
+)
+
+var (
+	ErrNoResponse  = errors.New("portmap: gateway did not respond")
+	ErrUnsupported = errors.New("portmap: protocol version not supported by gateway")
+)
+
+type Protocol string
+
+const (
+	PCP    Protocol = "pcp"
+	NATPMP Protocol = "natpmp"
+)
+
+// ResultError is failure result code of gateway
+type ResultError struct {
+	Protocol Protocol
+	Code     int
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("portmap: %s gateway result code %d", e.Protocol, e.Code)
+}
+
+type Mapping struct {
+	Protocol     Protocol
+	Gateway      string
+	InternalPort int
+	External     *net.UDPAddr
+	Lifetime     time.Duration // granted by gateway
+
+	nonce [12]byte // pcp mapping owner, same on renew and delete
+}
+
+// Map asks gateway for mapping of internal udp port, PCP is tried first,
+// NAT-PMP if gateway does not support it
+func Map(ctx context.Context, gateway string, internalPort int, lifetime time.Duration) (*Mapping, error) {
+	m, err := mapPCP(ctx, gateway, internalPort, lifetime, nil)
+	if err == nil {
+		return m, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if !errors.Is(err, ErrUnsupported) && !errors.Is(err, ErrNoResponse) {
+		return nil, err
+	}
+	return mapNATPMP(ctx, gateway, internalPort, lifetime, nil)
+}
+
+// Renew extends mapping with same protocol, external port is asked to stay same
+func Renew(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	if m.Protocol == PCP {
+		return mapPCP(ctx, m.Gateway, m.InternalPort, lifetime, m)
+	}
+	return mapNATPMP(ctx, m.Gateway, m.InternalPort, lifetime, m)
+}
+
+// Unmap deletes mapping on gateway
+func Unmap(ctx context.Context, m *Mapping) error {
+	var err error
+	if m.Protocol == PCP {
+		_, err = mapPCP(ctx, m.Gateway, m.InternalPort, 0, m)
+	} else {
+		_, err = mapNATPMP(ctx, m.Gateway, m.InternalPort, 0, m)
+	}
+	return err
+}
+
+// send request built for our local address and wait for response accepted by check,
+// with retransmissions, until ctx is done
+func exchange(ctx context.Context, gateway string, build func(local net.IP) []byte, check func(resp []byte) bool) ([]byte, error) {
+	addr, err := net.ResolveUDPAddr("udp", gateway)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	req := build(conn.LocalAddr().(*net.UDPAddr).IP)
+
+	// wake up blocked read, deadline set later is checked against ctx
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 1100) // max pcp message size
+	timeout := initialTimeout
+	for i := 0; i < maxAttempts; i++ {
+		_, err := conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		ctxDeadline, bounded := ctx.Deadline()
+		if bounded && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// read timed out at ctx deadline, before ctx itself is done
+		if bounded && !time.Now().Before(ctxDeadline) {
+			return nil, context.DeadlineExceeded
+		}
+		timeout *= 2
+	}
+	return nil, ErrNoResponse
+}
@@ -0,0 +1,247 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 7)
+
+// gateway on loopback, speaks NAT-PMP and optionally PCP,
+// suggested external port is honored only if it is the one already granted
+type fakeGateway struct {
+	t    *testing.T
+	conn *net.UDPConn
+	pcp  bool
+
+	mu       sync.Mutex
+	mappings map[int]int // external port, by internal port
+	nextPort int
+	requests map[int]int // by version
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{
+		t:        t,
+		conn:     conn,
+		pcp:      pcp,
+		mappings: make(map[int]int),
+		nextPort: 40000,
+		requests: make(map[int]int),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *fakeGateway) mapped(internal int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	port, ok := g.mappings[internal]
+	return port, ok
+}
+
+func (g *fakeGateway) count(version int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[version]
+}
+
+// grant mapping, or delete it for zero lifetime
+func (g *fakeGateway) grant(internal int, suggested int, lifetime uint32) int {
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return 0
+	}
+	if port, ok := g.mappings[internal]; ok && port == suggested {
+		return port
+	}
+	port := g.nextPort
+	g.nextPort++
+	g.mappings[internal] = port
+	return port
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		if len(req) < 2 {
+			continue
+		}
+
+		g.mu.Lock()
+		g.requests[int(req[0])]++
+		var resp []byte
+		switch {
+		case req[0] == pcpVersion && g.pcp:
+			resp = g.handlePCP(req)
+		case req[0] == pcpVersion:
+			// nat-pmp only gateway, rfc 6886 section 3.5
+			resp = make([]byte, 8)
+			resp[1] = natpmpRespFlag + req[1]
+			binary.BigEndian.PutUint16(resp[2:], natpmpUnsuppVers)
+		case req[0] == natpmpVersion:
+			resp = g.handleNATPMP(req)
+		}
+		g.mu.Unlock()
+
+		if resp != nil {
+			g.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (g *fakeGateway) handlePCP(req []byte) []byte {
+	if len(req) < pcpHeaderSize+pcpMapSize || req[1] != pcpOpMap {
+		return nil
+	}
+	lifetime := binary.BigEndian.Uint32(req[4:])
+	m := req[pcpHeaderSize:]
+	internal := int(binary.BigEndian.Uint16(m[16:]))
+	suggested := int(binary.BigEndian.Uint16(m[18:]))
+	port := g.grant(internal, suggested, lifetime)
+
+	resp := make([]byte, pcpResponseSize)
+	resp[0] = pcpVersion
+	resp[1] = pcpRespFlag + pcpOpMap
+	binary.BigEndian.PutUint32(resp[4:], lifetime)
+	rm := resp[pcpHeaderSize:]
+	copy(rm[0:12], m[0:12]) // nonce
+	rm[12] = pcpProtoUDP
+	binary.BigEndian.PutUint16(rm[16:], uint16(internal))
+	binary.BigEndian.PutUint16(rm[18:], uint16(port))
+	copy(rm[20:36], externalIP.To16())
+	return resp
+}
+
+func (g *fakeGateway) handleNATPMP(req []byte) []byte {
+	switch req[1] {
+	case natpmpOpAddr:
+		resp := make([]byte, 12)
+		resp[1] = natpmpRespFlag + natpmpOpAddr
+		copy(resp[8:], externalIP.To4())
+		return resp
+	case natpmpOpMapUDP:
+		if len(req) < 12 {
+			return nil
+		}
+		internal := int(binary.BigEndian.Uint16(req[4:]))
+		suggested := int(binary.BigEndian.Uint16(req[6:]))
+		lifetime := binary.BigEndian.Uint32(req[8:])
+		port := g.grant(internal, suggested, lifetime)
+
+		resp := make([]byte, 16)
+		resp[1] = natpmpRespFlag + natpmpOpMapUDP
+		binary.BigEndian.PutUint16(resp[8:], uint16(internal))
+		binary.BigEndian.PutUint16(resp[10:], uint16(port))
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		return resp
+	}
+	return nil
+}
+
+func testMapRenewUnmap(t *testing.T, pcp bool, want Protocol) {
+	g := newFakeGateway(t, pcp)
+	ctx := context.Background()
+
+	m, err := Map(ctx, g.addr(), 5000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != want {
+		t.Fatalf("protocol %s, want %s", m.Protocol, want)
+	}
+	if !m.External.IP.Equal(externalIP) || m.Lifetime != time.Hour {
+		t.Fatalf("mapping %v for %s, want %v for %s", m.External, m.Lifetime, externalIP, time.Hour)
+	}
+	if port, ok := g.mapped(5000); !ok || port != m.External.Port {
+		t.Fatalf("gateway maps %d, client got %d", port, m.External.Port)
+	}
+
+	renewed, err := Renew(ctx, m, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Protocol != want || renewed.External.Port != m.External.Port {
+		t.Fatalf("renewed %s %v, want %s %v", renewed.Protocol, renewed.External, want, m.External)
+	}
+
+	err = Unmap(ctx, renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, ok := g.mapped(5000); ok {
+		t.Fatalf("mapping to %d is not deleted", port)
+	}
+}
+
+func TestPCP(t *testing.T) {
+	testMapRenewUnmap(t, true, PCP)
+}
+
+func TestNATPMP(t *testing.T) {
+	testMapRenewUnmap(t, false, NATPMP)
+}
+
+func TestFallbackAfterPCPRejected(t *testing.T) {
+	g := newFakeGateway(t, false)
+	_, err := Map(context.Background(), g.addr(), 5000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.count(pcpVersion) != 1 || g.count(natpmpVersion) == 0 {
+		t.Fatalf("pcp requests %d, nat-pmp requests %d", g.count(pcpVersion), g.count(natpmpVersion))
+	}
+}
+
+func TestContextStopsExchange(t *testing.T) {
+	// bound, but never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = Map(ctx, silent.LocalAddr().String(), 5000, time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	err = Unmap(ctx, &Mapping{Protocol: NATPMP, Gateway: silent.LocalAddr().String(), InternalPort: 5000})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %s", elapsed)
+	}
+}
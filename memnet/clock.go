@@ -0,0 +1,155 @@
+package memnet
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock schedules delayed delivery of packets
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+// ManualClock moves only on Advance, it may be shared by network and nodes,
+// so timers of both fire in deadline order without real waiting. It implements
+// node.SettlingClock: next timer fires only after every node goroutine and every
+// queued packet is handled, so timers never race with work triggered by previous ones
+type ManualClock struct {
+	mu      sync.Mutex
+	settled *sync.Cond // signaled when busy drops to zero
+	now     time.Time
+	timers  []*manualTimer
+	busy    int // working goroutines and queued packets
+}
+
+type manualTimer struct {
+	at    time.Time
+	ch    chan time.Time // set for After and Sleep
+	f     func()         // set for AfterFunc
+	sleep bool           // goroutine woken by timer is counted busy
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	c := &ManualClock{now: start}
+	c.settled = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(&manualTimer{at: c.Now().Add(d), ch: ch})
+	return ch
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) {
+	c.add(&manualTimer{at: c.Now().Add(d), f: f})
+}
+
+func (c *ManualClock) add(t *manualTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, t)
+}
+
+// Busy counts goroutines doing work, Advance waits until there are none
+func (c *ManualClock) Busy(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy += delta
+	if c.busy <= 0 {
+		c.settled.Broadcast()
+	}
+}
+
+// Sleep waits d of clock time, calling goroutine stops being busy meanwhile,
+// returns false if ctx is done first
+func (c *ManualClock) Sleep(ctx context.Context, d time.Duration) bool {
+	t := &manualTimer{ch: make(chan time.Time, 1), sleep: true}
+	c.mu.Lock()
+	t.at = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.busy--
+	if c.busy <= 0 {
+		c.settled.Broadcast()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-t.ch:
+		return true
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, other := range c.timers {
+			if other == t {
+				// not fired, so not counted by Advance
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				c.busy++
+				break
+			}
+		}
+		return false
+	}
+}
+
+// wait until nothing is busy, must be called with mu held
+func (c *ManualClock) settle() {
+	for c.busy > 0 {
+		c.settled.Wait()
+	}
+}
+
+// Advance moves time forward, firing due timers one by one at their deadline,
+// each only after previous one was fully handled, functions run in caller goroutine
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		c.settle()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		if t.sleep {
+			c.busy++
+		}
+		c.mu.Unlock()
+
+		if t.f != nil {
+			t.f()
+		} else {
+			t.ch <- t.at
+		}
+	}
+}
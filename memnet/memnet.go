@@ -0,0 +1,312 @@
+// Package memnet is in memory packet network, node transport for tests,
+// with configurable loss, latency, reordering and partitions
+package memnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pavelverigo/natalie/node"
+)
+
+const queueSize = 1024 // packets waiting for read, further are dropped as in udp
+const firstEphemeralPort = 49152
+
+var (
+	ErrClosed    = errors.New("memnet: connection closed")
+	ErrAddrInUse = errors.New("memnet: address already in use")
+)
+
+// LinkConfig describes delivery between two hosts, in one direction
+type LinkConfig struct {
+	Loss    float64       // probability packet is dropped
+	Latency time.Duration // base delay
+	Jitter  time.Duration // random extra delay, up to
+	Reorder float64       // probability packet gets extra latency, so later packets overtake it
+}
+
+type Network struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	clock    Clock
+	def      LinkConfig
+	links    map[[2]string]LinkConfig // by source and destination host
+	blocked  map[[2]string]bool       // partitioned hosts, both orders are stored
+	conns    map[string]*Conn         // by host:port
+	nextPort map[string]int           // by host
+	nats     map[string]*NAT          // by public host
+}
+
+// New creates network, seed makes loss and reordering decisions repeatable
+func New(seed int64) *Network {
+	return &Network{
+		rand:     rand.New(rand.NewSource(seed)),
+		clock:    realClock{},
+		links:    make(map[[2]string]LinkConfig),
+		blocked:  make(map[[2]string]bool),
+		conns:    make(map[string]*Conn),
+		nextPort: make(map[string]int),
+		nats:     make(map[string]*NAT),
+	}
+}
+
+// SetClock makes delayed delivery use clock timers, should be called before Listen
+func (nw *Network) SetClock(c Clock) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.clock = c
+}
+
+// SetDefault sets config of links without own config
+func (nw *Network) SetDefault(cfg LinkConfig) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.def = cfg
+}
+
+// SetLink sets config of packets from one host to other
+func (nw *Network) SetLink(from string, to string, cfg LinkConfig) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.links[[2]string{from, to}] = cfg
+}
+
+// Partition drops all packets between two hosts, until Heal
+func (nw *Network) Partition(a string, b string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.blocked[[2]string{a, b}] = true
+	nw.blocked[[2]string{b, a}] = true
+}
+
+func (nw *Network) Heal(a string, b string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.blocked, [2]string{a, b})
+	delete(nw.blocked, [2]string{b, a})
+}
+
+// Listen opens connection on host:port, port 0 picks free ephemeral port
+func (nw *Network) Listen(addr string) (*Conn, error) {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if port == 0 {
+		port = freePort(nw.conns, nw.nextPort, host)
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(port))
+	if _, ok := nw.conns[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	c := newConn(nw, addr, host)
+	nw.conns[addr] = c
+	return c, nil
+}
+
+func splitAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func freePort(conns map[string]*Conn, nextPort map[string]int, host string) int {
+	port := nextPort[host]
+	if port == 0 {
+		port = firstEphemeralPort
+	}
+	for {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if _, ok := conns[addr]; !ok {
+			break
+		}
+		port++
+	}
+	nextPort[host] = port + 1
+	return port
+}
+
+// send applies link config and schedules delivery, must be called with mu held
+func (nw *Network) send(from string, fromHost string, to string, data []byte) {
+	toHost, _, err := net.SplitHostPort(to)
+	if err != nil {
+		return
+	}
+	if nw.blocked[[2]string{fromHost, toHost}] {
+		return
+	}
+	cfg, ok := nw.links[[2]string{fromHost, toHost}]
+	if !ok {
+		cfg = nw.def
+	}
+	if cfg.Loss > 0 && nw.rand.Float64() < cfg.Loss {
+		return
+	}
+
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		delay += time.Duration(nw.rand.Int63n(int64(cfg.Jitter)))
+	}
+	if cfg.Reorder > 0 && nw.rand.Float64() < cfg.Reorder {
+		delay += cfg.Latency + cfg.Jitter + time.Millisecond
+	}
+
+	d := datagram{from: from, data: data}
+	if delay == 0 {
+		nw.deliver(to, d)
+		return
+	}
+	nw.clock.AfterFunc(delay, func() {
+		nw.mu.Lock()
+		defer nw.mu.Unlock()
+		nw.deliver(to, d)
+	})
+}
+
+// must be called with mu held
+func (nw *Network) deliver(to string, d datagram) {
+	if c, ok := nw.conns[to]; ok {
+		c.push(d)
+		return
+	}
+	host, _, err := net.SplitHostPort(to)
+	if err != nil {
+		return
+	}
+	if nat, ok := nw.nats[host]; ok {
+		nat.inbound(d, to)
+	}
+}
+
+type datagram struct {
+	from string
+	data []byte
+}
+
+// Conn is endpoint of network, implements node.Transport
+type Conn struct {
+	nw        *Network
+	nat       *NAT // nil on public host
+	addr      string
+	host      string
+	queue     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(nw *Network, addr string, host string) *Conn {
+	return &Conn{
+		nw:     nw,
+		addr:   addr,
+		host:   host,
+		queue:  make(chan datagram, queueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// counts work for settling clock, queued packet is work until reader takes it
+type busyCounter interface {
+	Busy(delta int)
+}
+
+func (nw *Network) busy(delta int) {
+	if b, ok := nw.clock.(busyCounter); ok {
+		b.Busy(delta)
+	}
+}
+
+// must be called with nw.mu held
+func (c *Conn) push(d datagram) {
+	select {
+	case c.queue <- d:
+		c.nw.busy(1)
+	default: // full, dropped
+	}
+}
+
+// reader is idle while it waits, taken packet continues as its work
+func (c *Conn) ReadFrom(p []byte) (int, string, error) {
+	c.nw.busy(-1)
+	select {
+	case d := <-c.queue:
+		return copy(p, d.data), d.from, nil
+	case <-c.closed:
+		c.nw.busy(1)
+		return 0, "", ErrClosed
+	}
+}
+
+func (c *Conn) WriteTo(p []byte, addr string) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	c.nw.mu.Lock()
+	defer c.nw.mu.Unlock()
+	if c.nat != nil {
+		c.nat.send(c, addr, data)
+	} else {
+		c.nw.send(c.addr, c.host, addr, data)
+	}
+	return len(p), nil
+}
+
+func (c *Conn) LocalAddr() string {
+	return c.addr
+}
+
+func (c *Conn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		c.nw.mu.Lock()
+		if c.nat != nil {
+			delete(c.nat.conns, c.addr)
+		} else {
+			delete(c.nw.conns, c.addr)
+		}
+		c.nw.mu.Unlock()
+		for {
+			select {
+			case <-c.queue:
+				c.nw.busy(-1) // never read
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+// ListenAltPort opens connection on same host, other port
+func (c *Conn) ListenAltPort() (node.Transport, error) {
+	addr := net.JoinHostPort(c.host, "0")
+	if c.nat != nil {
+		return c.nat.Listen(addr)
+	}
+	return c.nw.Listen(addr)
+}
+
+var (
+	_ node.Transport        = (*Conn)(nil)
+	_ node.AltPortTransport = (*Conn)(nil)
+)
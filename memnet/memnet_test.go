@@ -0,0 +1,239 @@
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pavelverigo/natalie/node"
+)
+
+// network and nodes sharing manual clock
+type testNet struct {
+	t     *testing.T
+	nw    *Network
+	clock *ManualClock
+}
+
+func newTestNet(t *testing.T, seed int64) *testNet {
+	nw := New(seed)
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	nw.SetClock(clock)
+	return &testNet{t: t, nw: nw, clock: clock}
+}
+
+func (tn *testNet) start(name string, c *Conn, opts ...node.Option) node.Node {
+	tn.t.Helper()
+	opts = append(opts, node.WithTransport(c), node.WithClock(tn.clock))
+	n, err := node.New(name, 0, log.New(io.Discard, "", 0), opts...)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	err = n.Start()
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	tn.t.Cleanup(func() { n.Stop() })
+	return n
+}
+
+func (tn *testNet) listen(name string, addr string, opts ...node.Option) node.Node {
+	tn.t.Helper()
+	c, err := tn.nw.Listen(addr)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return tn.start(name, c, opts...)
+}
+
+// same latency in both directions
+func (tn *testNet) link(a string, b string, latency time.Duration) {
+	tn.nw.SetLink(a, b, LinkConfig{Latency: latency})
+	tn.nw.SetLink(b, a, LinkConfig{Latency: latency})
+}
+
+// a-b-c-d-e chain with 10ms links, slow a-e and b-d shortcuts
+func runConvergence(t *testing.T) map[string]map[string][]string {
+	tn := newTestNet(t, 1)
+	tn.nw.SetDefault(LinkConfig{Latency: 10 * time.Millisecond})
+	tn.link("10.0.0.1", "10.0.0.5", 100*time.Millisecond)
+	tn.link("10.0.0.2", "10.0.0.4", 50*time.Millisecond)
+
+	names := []string{"a", "b", "c", "d", "e"}
+	nodes := make(map[string]node.Node, len(names))
+	for i, name := range names {
+		nodes[name] = tn.listen(name, fmt.Sprintf("10.0.0.%d:1000", i+1))
+	}
+	for _, l := range [][2]int{{1, 2}, {2, 3}, {3, 4}, {4, 5}, {1, 5}, {2, 4}} {
+		nodes[names[l[0]-1]].DirectHandshake(fmt.Sprintf("10.0.0.%d:1000", l[1]))
+	}
+	tn.clock.Advance(time.Minute)
+
+	checkPath(t, nodes["a"], "e", "a", "b", "c", "d", "e")
+	checkPath(t, nodes["e"], "a", "e", "d", "c", "b", "a")
+	checkPath(t, nodes["a"], "d", "a", "b", "c", "d")
+	for _, from := range names {
+		if routes := nodes[from].Routes(); len(routes) != len(names) {
+			t.Fatalf("%s knows routes to %d nodes, want %d", from, len(routes), len(names))
+		}
+	}
+
+	// c-d link breaks, traffic goes over b-d shortcut
+	tn.nw.Partition("10.0.0.3", "10.0.0.4")
+	tn.clock.Advance(time.Minute)
+
+	checkPath(t, nodes["a"], "e", "a", "b", "d", "e")
+	checkPath(t, nodes["c"], "d", "c", "b", "d")
+
+	// paths by source and destination, timestamps depend on order of simultaneous events
+	paths := make(map[string]map[string][]string, len(names))
+	for _, name := range names {
+		paths[name] = make(map[string][]string)
+		for dest, route := range nodes[name].Routes() {
+			paths[name][dest] = route.Path
+		}
+	}
+	return paths
+}
+
+func checkPath(t *testing.T, n node.Node, dest string, want ...string) {
+	t.Helper()
+	route, ok := n.Routes()[dest]
+	if !ok {
+		t.Fatalf("no route to %s", dest)
+	}
+	if !reflect.DeepEqual(route.Path, want) {
+		t.Fatalf("path to %s is %v, want %v", dest, route.Path, want)
+	}
+}
+
+func TestRoutingConvergence(t *testing.T) {
+	first := runConvergence(t)
+	second := runConvergence(t)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("runs with same seed differ:\n%v\n%v", first, second)
+	}
+}
+
+// fragments of packet for non neighbor are forwarded by relay, inner packet is json
+func TestLargeChatThroughRelay(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.nw.SetDefault(LinkConfig{Latency: 10 * time.Millisecond})
+	a := tn.listen("a", "10.0.0.1:1000")
+	tn.listen("r", "10.0.0.2:1000")
+	b := tn.listen("b", "10.0.0.3:1000")
+	a.DirectHandshake("10.0.0.2:1000")
+	b.DirectHandshake("10.0.0.2:1000")
+	tn.clock.Advance(10 * time.Second)
+
+	text := strings.Repeat("x", 100<<10)
+	id, err := a.SendChat("b", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.clock.Advance(5 * time.Second)
+	if status := a.DeliveryStatus(id); status != node.DeliveryDelivered {
+		t.Fatalf("chat is %s", status)
+	}
+	chat := b.Chat()
+	if len(chat) != 1 || chat[0].Text != text {
+		t.Fatalf("received %d chats", len(chat))
+	}
+	if stats := b.Stats(); stats.Reassembled != 1 {
+		t.Fatalf("reassembled %d packets", stats.Reassembled)
+	}
+}
+
+// packets cross json and binary links: a -bin- b -json- r -json- c -bin- d, where only r uses json
+func TestJSONRelayBetweenBinaryNodes(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.nw.SetDefault(LinkConfig{Latency: 10 * time.Millisecond})
+	a := tn.listen("a", "10.0.0.1:1000")
+	b := tn.listen("b", "10.0.0.2:1000")
+	tn.listen("r", "10.0.0.3:1000", node.WithJSONWire())
+	c := tn.listen("c", "10.0.0.4:1000")
+	d := tn.listen("d", "10.0.0.5:1000")
+	a.DirectHandshake("10.0.0.2:1000")
+	b.DirectHandshake("10.0.0.3:1000")
+	c.DirectHandshake("10.0.0.3:1000")
+	c.DirectHandshake("10.0.0.5:1000")
+	tn.clock.Advance(30 * time.Second)
+	checkPath(t, a, "d", "a", "b", "r", "c", "d")
+
+	for _, text := range []string{"hello <d> & co", strings.Repeat("y", 20<<10)} {
+		id, err := a.SendChat("d", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tn.clock.Advance(5 * time.Second)
+		if status := a.DeliveryStatus(id); status != node.DeliveryDelivered {
+			t.Fatalf("chat of %d bytes is %s", len(text), status)
+		}
+		chat := d.Chat()
+		if got := chat[len(chat)-1]; got.Source != "a" || got.Text != text {
+			t.Fatalf("received %q", got.Text)
+		}
+	}
+	if bad := b.BadPackets(); len(bad) != 0 {
+		t.Fatalf("bad packets %v", bad)
+	}
+}
+
+// packet rejected by handler is not acked, also when it is retransmitted
+func TestRejectedPacketNotAcked(t *testing.T) {
+	tn := newTestNet(t, 1)
+	a := tn.listen("a", "10.0.0.1:1000")
+	b := tn.listen("b", "10.0.0.2:1000")
+	err := b.RegisterHandler("strict", node.Handler{
+		Routable: true,
+		Decode:   func(payload []byte) (any, error) { return nil, errors.New("rejected") },
+		Handle:   func(src string, msg any) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DirectHandshake("10.0.0.2:1000")
+	tn.clock.Advance(5 * time.Second)
+
+	id, err := a.SendReliable("b", "strict", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.clock.Advance(time.Minute)
+	if status := a.DeliveryStatus(id); status != node.DeliveryFailed {
+		t.Fatalf("rejected packet is %s", status)
+	}
+}
+
+// partial message of sender, which went silent mid message, is dropped on timeout
+func TestPartialMessageExpires(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.nw.SetDefault(LinkConfig{Latency: 10 * time.Millisecond})
+	a := tn.listen("a", "10.0.0.1:1000")
+	b := tn.listen("b", "10.0.0.2:1000")
+	a.DirectHandshake("10.0.0.2:1000")
+	tn.clock.Advance(5 * time.Second)
+	_, err := a.SendChat("b", "key exchange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.clock.Advance(time.Second)
+
+	// first burst is already on the way
+	_, err = a.SendChat("b", strings.Repeat("z", 100<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.nw.Partition("10.0.0.1", "10.0.0.2")
+	tn.clock.Advance(20 * time.Second)
+
+	stats := b.Stats()
+	if stats.Reassembled != 0 || stats.ReassemblyDropped != 1 {
+		t.Fatalf("reassembled %d, dropped %d", stats.Reassembled, stats.ReassemblyDropped)
+	}
+}
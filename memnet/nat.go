@@ -0,0 +1,200 @@
+package memnet
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+type NATType string
+
+const (
+	FullCone       NATType = "full-cone"       // any host may send to mapping
+	Restricted     NATType = "restricted"      // only hosts we sent to
+	PortRestricted NATType = "port-restricted" // only host and port we sent to
+	Symmetric      NATType = "symmetric"       // new mapping for every remote address
+)
+
+const defaultMappingTimeout = 30 * time.Second
+const firstMappedPort = 20000
+
+type NATConfig struct {
+	Type        NATType
+	Timeout     time.Duration // mapping without outbound packets expires, 0 is 30s
+	Hairpin     bool          // private hosts reach each other through public address
+	RandomPorts bool          // allocate public ports randomly, sequentially by default
+}
+
+// NAT translates packets of private hosts to its public host
+type NAT struct {
+	nw     *Network
+	public string // host
+	cfg    NATConfig
+
+	conns    map[string]*Conn    // private hosts, by host:port
+	nextPort map[string]int      // of private hosts, by host
+	mappings map[string]*mapping // by private addr, and remote addr for symmetric
+	byPort   map[int]*mapping
+	port     int // next public port, for sequential allocation
+}
+
+type mapping struct {
+	key      string // in mappings
+	private  string
+	port     int
+	lastUsed time.Time
+	permits  map[string]time.Time // remote addr or host, by filtering type
+}
+
+// AddNAT creates nat with public host address, hosts behind it listen with NAT.Listen
+func (nw *Network) AddNAT(public string, cfg NATConfig) *NAT {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultMappingTimeout
+	}
+	nat := &NAT{
+		nw:       nw,
+		public:   public,
+		cfg:      cfg,
+		conns:    make(map[string]*Conn),
+		nextPort: make(map[string]int),
+		mappings: make(map[string]*mapping),
+		byPort:   make(map[int]*mapping),
+		port:     firstMappedPort,
+	}
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nats[public] = nat
+	return nat
+}
+
+// Listen opens connection on private host:port behind nat, port 0 picks free one
+func (nat *NAT) Listen(addr string) (*Conn, error) {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nat.nw.mu.Lock()
+	defer nat.nw.mu.Unlock()
+	if port == 0 {
+		port = freePort(nat.conns, nat.nextPort, host)
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(port))
+	if _, ok := nat.conns[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	c := newConn(nat.nw, addr, host)
+	c.nat = nat
+	nat.conns[addr] = c
+	return c, nil
+}
+
+// send from private conn, must be called with mu held
+func (nat *NAT) send(c *Conn, to string, data []byte) {
+	if other, ok := nat.conns[to]; ok {
+		// same private network, without link delays, private addresses of nats may overlap
+		other.push(datagram{from: c.addr, data: data})
+		return
+	}
+
+	toHost, _, err := net.SplitHostPort(to)
+	if err != nil {
+		return
+	}
+	m := nat.outbound(c.addr, to)
+	from := net.JoinHostPort(nat.public, strconv.Itoa(m.port))
+	if toHost == nat.public {
+		if nat.cfg.Hairpin {
+			nat.inbound(datagram{from: from, data: data}, to)
+		}
+		return
+	}
+	nat.nw.send(from, nat.public, to, data)
+}
+
+// mapping for outbound packet, refreshed and permitting responses from remote
+func (nat *NAT) outbound(private string, remote string) *mapping {
+	now := nat.nw.clock.Now()
+	key := private
+	if nat.cfg.Type == Symmetric {
+		key = private + "|" + remote
+	}
+
+	m, ok := nat.mappings[key]
+	if !ok || now.Sub(m.lastUsed) > nat.cfg.Timeout {
+		if ok && nat.byPort[m.port] == m {
+			delete(nat.byPort, m.port)
+		}
+		m = &mapping{
+			key:     key,
+			private: private,
+			port:    nat.allocPort(),
+			permits: make(map[string]time.Time),
+		}
+		nat.mappings[key] = m
+		nat.byPort[m.port] = m
+	}
+	m.lastUsed = now
+	m.permits[nat.permitKey(remote)] = now
+	return m
+}
+
+func (nat *NAT) allocPort() int {
+	for {
+		var port int
+		if nat.cfg.RandomPorts {
+			port = firstMappedPort + nat.nw.rand.Intn(65536-firstMappedPort)
+		} else {
+			port = nat.port
+			nat.port++
+			if nat.port > 65535 {
+				nat.port = firstMappedPort
+			}
+		}
+		m, ok := nat.byPort[port]
+		if !ok {
+			return port
+		}
+		if nat.nw.clock.Now().Sub(m.lastUsed) > nat.cfg.Timeout {
+			// expired mapping gives port away, so it can not take it back later
+			delete(nat.byPort, port)
+			if nat.mappings[m.key] == m {
+				delete(nat.mappings, m.key)
+			}
+			return port
+		}
+	}
+}
+
+func (nat *NAT) permitKey(remote string) string {
+	if nat.cfg.Type == Restricted {
+		host, _, _ := net.SplitHostPort(remote)
+		return host
+	}
+	return remote
+}
+
+// packet to public address, delivered to private host if mapping exists and filter permits,
+// must be called with mu held
+func (nat *NAT) inbound(d datagram, to string) {
+	_, port, err := splitAddr(to)
+	if err != nil {
+		return
+	}
+	m, ok := nat.byPort[port]
+	now := nat.nw.clock.Now()
+	if !ok || now.Sub(m.lastUsed) > nat.cfg.Timeout {
+		return
+	}
+	if nat.cfg.Type != FullCone {
+		t, ok := m.permits[nat.permitKey(d.from)]
+		if !ok || now.Sub(t) > nat.cfg.Timeout {
+			return
+		}
+	}
+	c, ok := nat.conns[m.private]
+	if !ok {
+		return
+	}
+	c.push(d)
+}
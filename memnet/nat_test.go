@@ -0,0 +1,305 @@
+package memnet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pavelverigo/natalie/node"
+)
+
+var natTypes = []NATType{FullCone, Restricted, PortRestricted, Symmetric}
+
+// without port prediction, symmetric nat is traversed only if other side does not filter by port
+func expectedTraversal(a NATType, b NATType) node.TraversalState {
+	hard := func(t NATType) bool { return t == PortRestricted || t == Symmetric }
+	if (a == Symmetric && hard(b)) || (b == Symmetric && hard(a)) {
+		return node.TraversalRelayed
+	}
+	return node.TraversalDirect
+}
+
+// peers a and b behind own nats, both connected to public relay r
+func natPair(t *testing.T, a NATConfig, b NATConfig) (*testNet, node.Node, node.Node) {
+	tn := newTestNet(t, 1)
+	tn.nw.SetDefault(LinkConfig{Latency: 5 * time.Millisecond})
+	tn.listen("r", "1.0.0.1:1000")
+
+	ca, err := tn.nw.AddNAT("5.0.0.1", a).Listen("192.168.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := tn.nw.AddNAT("6.0.0.1", b).Listen("192.168.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	na := tn.start("a", ca)
+	nb := tn.start("b", cb)
+	na.DirectHandshake("1.0.0.1:1000")
+	nb.DirectHandshake("1.0.0.1:1000")
+	tn.clock.Advance(5 * time.Second)
+	return tn, na, nb
+}
+
+func checkTraversal(t *testing.T, n node.Node, peer string, want node.TraversalState) {
+	t.Helper()
+	info, ok := n.Traversals()[peer]
+	if !ok {
+		t.Fatalf("no traversal to %s", peer)
+	}
+	if info.State != want {
+		t.Fatalf("traversal to %s is %s, want %s", peer, info.State, want)
+	}
+	_, neighbor := n.Neighbors()[peer]
+	if neighbor != (want == node.TraversalDirect) {
+		t.Fatalf("traversal to %s is %s, but neighbor is %v", peer, info.State, neighbor)
+	}
+}
+
+func TestTraversalMatrix(t *testing.T) {
+	for _, coordinated := range []bool{false, true} {
+		for _, ta := range natTypes {
+			for _, tb := range natTypes {
+				ta, tb, coordinated := ta, tb, coordinated
+				t.Run(fmt.Sprintf("%s-%s-coordinated-%v", ta, tb, coordinated), func(t *testing.T) {
+					tn, a, _ := natPair(t, NATConfig{Type: ta}, NATConfig{Type: tb})
+					err := a.Traverse("b", node.TraversalOptions{Coordinated: coordinated})
+					if err != nil {
+						t.Fatal(err)
+					}
+					tn.clock.Advance(20 * time.Second)
+					checkTraversal(t, a, "b", expectedTraversal(ta, tb))
+				})
+			}
+		}
+	}
+}
+
+func TestTraversalHairpin(t *testing.T) {
+	for _, hairpin := range []bool{true, false} {
+		hairpin := hairpin
+		t.Run(fmt.Sprintf("hairpin-%v", hairpin), func(t *testing.T) {
+			tn := newTestNet(t, 1)
+			tn.nw.SetDefault(LinkConfig{Latency: 5 * time.Millisecond})
+			tn.listen("r", "1.0.0.1:1000")
+
+			// same nat, peers know only public addresses of each other
+			nat := tn.nw.AddNAT("5.0.0.1", NATConfig{Type: PortRestricted, Hairpin: hairpin})
+			ca, err := nat.Listen("192.168.0.2:1000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cb, err := nat.Listen("192.168.0.3:1000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := tn.start("a", ca)
+			b := tn.start("b", cb)
+			a.DirectHandshake("1.0.0.1:1000")
+			b.DirectHandshake("1.0.0.1:1000")
+			tn.clock.Advance(5 * time.Second)
+
+			err = a.Traverse("b", node.TraversalOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tn.clock.Advance(20 * time.Second)
+			want := node.TraversalRelayed
+			if hairpin {
+				want = node.TraversalDirect
+			}
+			checkTraversal(t, a, "b", want)
+		})
+	}
+}
+
+func TestNATMappingTimeout(t *testing.T) {
+	tn := newTestNet(t, 1)
+	server, err := tn.nw.Listen("1.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nat := tn.nw.AddNAT("5.0.0.1", NATConfig{Type: PortRestricted, Timeout: 10 * time.Second})
+	client, err := nat.Listen("192.168.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	roundTrip := func() string {
+		t.Helper()
+		client.WriteTo([]byte("ping"), "1.0.0.1:1000")
+		_, from, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from
+	}
+
+	mapped := roundTrip()
+	if mapped != "5.0.0.1:20000" {
+		t.Fatalf("mapped to %s", mapped)
+	}
+
+	// outbound packets keep mapping
+	tn.clock.Advance(8 * time.Second)
+	if from := roundTrip(); from != mapped {
+		t.Fatalf("mapping changed to %s before timeout", from)
+	}
+	tn.clock.Advance(8 * time.Second)
+	server.WriteTo([]byte("pong"), mapped)
+	if len(client.queue) != 1 {
+		t.Fatal("reply within timeout is dropped")
+	}
+	client.ReadFrom(buf)
+
+	// expired mapping drops inbound, next outbound gets new port
+	tn.clock.Advance(11 * time.Second)
+	server.WriteTo([]byte("pong"), mapped)
+	if len(client.queue) != 0 {
+		t.Fatal("reply to expired mapping is delivered")
+	}
+	if from := roundTrip(); from == mapped {
+		t.Fatalf("expired mapping %s is reused", from)
+	}
+}
+
+func TestTraversedPeersKeepMapping(t *testing.T) {
+	cfg := NATConfig{Type: PortRestricted, Timeout: 8 * time.Second} // longer than keep alive interval
+	tn, a, b := natPair(t, cfg, cfg)
+	err := a.Traverse("b", node.TraversalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.clock.Advance(20 * time.Second)
+	checkTraversal(t, a, "b", node.TraversalDirect)
+
+	tn.clock.Advance(2 * time.Minute)
+	if _, ok := a.Neighbors()["b"]; !ok {
+		t.Fatal("a lost direct neighbor b")
+	}
+	if _, ok := b.Neighbors()["r"]; !ok {
+		t.Fatal("b lost relay r")
+	}
+}
+
+// port of expired mapping is given to other host, old host gets new port
+func TestNATReusesExpiredPort(t *testing.T) {
+	tn := newTestNet(t, 1)
+	server, err := tn.nw.Listen("1.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nat := tn.nw.AddNAT("5.0.0.1", NATConfig{Type: PortRestricted, Timeout: 10 * time.Second})
+	first, err := nat.Listen("192.168.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nat.Listen("192.168.0.3:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	send := func(c *Conn) string {
+		t.Helper()
+		c.WriteTo([]byte("ping"), "1.0.0.1:1000")
+		_, from, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from
+	}
+
+	mapped := send(first)
+	tn.clock.Advance(11 * time.Second)
+	nat.port = firstMappedPort // wrap around to expired port
+	if from := send(second); from != mapped {
+		t.Fatalf("second host mapped to %s, want reused %s", from, mapped)
+	}
+	if from := send(first); from == mapped {
+		t.Fatalf("first host took back %s", from)
+	}
+
+	server.WriteTo([]byte("pong"), mapped)
+	if len(second.queue) != 1 || len(first.queue) != 0 {
+		t.Fatalf("reply to reused port delivered to first %d, second %d", len(first.queue), len(second.queue))
+	}
+}
+
+// p behind nat asks public r1 and r2, r3 is neighbor of both, which p never contacted
+func TestNATDetection(t *testing.T) {
+	for _, typ := range natTypes {
+		typ := typ
+		t.Run(string(typ), func(t *testing.T) {
+			tn := newTestNet(t, 1)
+			tn.nw.SetDefault(LinkConfig{Latency: 5 * time.Millisecond})
+			tn.listen("r1", "1.0.0.1:1000")
+			tn.listen("r2", "1.0.0.2:1000")
+			r3 := tn.listen("r3", "1.0.0.3:1000")
+			r3.DirectHandshake("1.0.0.1:1000")
+			r3.DirectHandshake("1.0.0.2:1000")
+
+			c, err := tn.nw.AddNAT("5.0.0.1", NATConfig{Type: typ}).Listen("192.168.0.2:1000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := tn.start("p", c)
+			p.DirectHandshake("1.0.0.1:1000")
+			p.DirectHandshake("1.0.0.2:1000")
+			tn.clock.Advance(5 * time.Second)
+
+			err = p.DetectNAT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tn.clock.Advance(5 * time.Second)
+			if got := p.NAT().Type; string(got) != string(typ) {
+				t.Fatalf("detected %s", got)
+			}
+		})
+	}
+}
+
+func TestTraversalPortPrediction(t *testing.T) {
+	// symmetric nat allocates ports sequentially, so they are predictable
+	for _, predict := range []node.PortPrediction{node.PredictNone, node.PredictLinear, node.PredictRange} {
+		predict := predict
+		t.Run(fmt.Sprintf("predict-%q", predict), func(t *testing.T) {
+			tn := newTestNet(t, 1)
+			tn.nw.SetDefault(LinkConfig{Latency: 5 * time.Millisecond})
+			tn.listen("r1", "1.0.0.1:1000")
+			tn.listen("r2", "1.0.0.2:1000")
+
+			ca, err := tn.nw.AddNAT("5.0.0.1", NATConfig{Type: Symmetric}).Listen("192.168.0.2:1000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cb, err := tn.nw.AddNAT("6.0.0.1", NATConfig{Type: PortRestricted}).Listen("192.168.0.2:1000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := tn.start("a", ca)
+			b := tn.start("b", cb)
+			for _, n := range []node.Node{a, b} {
+				n.DirectHandshake("1.0.0.1:1000")
+				n.DirectHandshake("1.0.0.2:1000")
+			}
+			tn.clock.Advance(5 * time.Second)
+
+			err = a.Traverse("b", node.TraversalOptions{Predict: predict})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tn.clock.Advance(20 * time.Second)
+			if predict == node.PredictNone {
+				checkTraversal(t, a, "b", expectedTraversal(Symmetric, PortRestricted))
+				return
+			}
+			checkTraversal(t, a, "b", node.TraversalDirect)
+			if nat := a.NAT().Type; nat != node.NATSymmetric {
+				t.Fatalf("detected %s", nat)
+			}
+		})
+	}
+}
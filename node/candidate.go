@@ -0,0 +1,199 @@
+package node
+
+import (
+	"net"
+	"sort"
+)
+
+type CandidateType string
+
+const (
+	CandidateHost      CandidateType = "host"   // local interface address
+	CandidateReflexive CandidateType = "srflx"  // our address as seen by peers
+	CandidateMapped    CandidateType = "mapped" // external port mapped on gateway
+	CandidatePeer      CandidateType = "prflx"  // learned from successful check
+	CandidateRelay     CandidateType = "relay"  // virtual neighbor through relay node
+)
+
+// ice like type preference, direct paths are always preferred over relay
+var candidateTypePref = map[CandidateType]uint32{
+	CandidateHost:      126,
+	CandidatePeer:      110,
+	CandidateMapped:    105,
+	CandidateReflexive: 100,
+	CandidateRelay:     0,
+}
+
+type Candidate struct {
+	Type     CandidateType `json:"type"`
+	Addr     string        `json:"addr,omitempty"`
+	Relay    string        `json:"relay,omitempty"` // node name, for relay candidate
+	Priority uint32        `json:"priority"`
+}
+
+type CandidatePair struct {
+	Local  Candidate `json:"local"`
+	Remote Candidate `json:"remote"`
+}
+
+// ipv6 is preferred, it usually does not need nat traversal
+func addrPreference(addr string) uint32 {
+	if isIPv6(addr) {
+		return 65535
+	}
+	return 32767
+}
+
+func candidatePriority(typ CandidateType, localPref uint32) uint32 {
+	return candidateTypePref[typ]<<24 | (localPref&0xffff)<<8 | 255 // single component
+}
+
+// pair priority as in ice, g is priority of controlling side candidate
+func pairPriority(g uint32, d uint32) uint64 {
+	lo, hi := uint64(g), uint64(d)
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	p := lo<<32 + 2*hi
+	if g > d {
+		p++
+	}
+	return p
+}
+
+// host candidates from all interfaces, only if local, reflexive from peers,
+// and relay through node on current route
+func (n *node) gatherCandidates(peer string, local bool) []Candidate {
+	candidates := make([]Candidate, 0)
+	if local {
+		candidates = append(candidates, n.hostCandidates()...)
+	}
+	if addr, ok := n.mappedAddr(n.clock.Now()); ok {
+		candidates = append(candidates, Candidate{
+			Type:     CandidateMapped,
+			Addr:     addr,
+			Priority: candidatePriority(CandidateMapped, addrPreference(addr)),
+		})
+	}
+	for _, addr := range n.knownAddr.Keys() {
+		candidates = append(candidates, Candidate{
+			Type:     CandidateReflexive,
+			Addr:     addr,
+			Priority: candidatePriority(CandidateReflexive, addrPreference(addr)),
+		})
+	}
+	if relay, ok := n.routingTable[peer]; ok && relay != peer && relay != n.name {
+		candidates = append(candidates, Candidate{
+			Type:     CandidateRelay,
+			Relay:    relay,
+			Priority: candidatePriority(CandidateRelay, 65535),
+		})
+	}
+	sortCandidates(candidates)
+	return candidates
+}
+
+func (n *node) hostCandidates() []Candidate {
+	addrs, err := n.interfaceAddrs()
+	if err != nil {
+		n.log.Println("host candidates:", err)
+		return nil
+	}
+	candidates := make([]Candidate, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		// link local would need zone, both families are advertised
+		if err != nil || ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Type:     CandidateHost,
+			Addr:     addr,
+			Priority: candidatePriority(CandidateHost, addrPreference(addr)),
+		})
+	}
+	return candidates
+}
+
+func sortCandidates(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+}
+
+// remote addresses to check in order of pair priority
+func checkOrder(local []Candidate, remote []Candidate, controlling bool) []Candidate {
+	best := uint32(0)
+	for _, c := range local {
+		if c.Type != CandidateRelay && c.Priority > best {
+			best = c.Priority
+		}
+	}
+
+	type check struct {
+		remote   Candidate
+		priority uint64
+	}
+	checks := make([]check, 0, len(remote))
+	seen := make(map[string]bool)
+	for _, c := range remote {
+		if c.Type == CandidateRelay || c.Addr == "" || seen[c.Addr] {
+			continue
+		}
+		seen[c.Addr] = true
+		p := pairPriority(c.Priority, best)
+		if controlling {
+			p = pairPriority(best, c.Priority)
+		}
+		checks = append(checks, check{remote: c, priority: p})
+	}
+	sort.SliceStable(checks, func(i, j int) bool {
+		return checks[i].priority > checks[j].priority
+	})
+
+	r := make([]Candidate, len(checks))
+	for i, c := range checks {
+		r[i] = c.remote
+	}
+	return r
+}
+
+// candidates of peer, peers without candidates support send only addresses
+func remoteCandidates(candidates []Candidate, addrs []string) []Candidate {
+	if len(candidates) > 0 {
+		return candidates
+	}
+	candidates = make([]Candidate, len(addrs))
+	for i, addr := range addrs {
+		candidates[i] = Candidate{
+			Type:     CandidateReflexive,
+			Addr:     addr,
+			Priority: candidatePriority(CandidateReflexive, addrPreference(addr)),
+		}
+	}
+	return candidates
+}
+
+func findCandidate(candidates []Candidate, addr string) Candidate {
+	for _, c := range candidates {
+		if c.Addr == addr {
+			return c
+		}
+	}
+	return Candidate{
+		Type:     CandidatePeer,
+		Addr:     addr,
+		Priority: candidatePriority(CandidatePeer, addrPreference(addr)),
+	}
+}
+
+func candidateAddrs(candidates []Candidate) []string {
+	addrs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if c.Addr != "" {
+			addrs = append(addrs, c.Addr)
+		}
+	}
+	return addrs
+}
@@ -3,8 +3,6 @@ package node
 import (
 	"encoding/json"
 	"errors"
-	"log"
-	"time"
 )
 
 type chatMsg struct {
@@ -15,16 +13,25 @@ func (msg *chatMsg) Type() string {
 	return "chat"
 }
 
-func (n *node) processChat(pkt *packet, addr string) error {
+func decodeChat(payload []byte) (any, error) {
 	msg := &chatMsg{}
-	err := json.Unmarshal(pkt.Payload, msg)
+	err := json.Unmarshal(payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	return msg, nil
+}
+
+func (n *node) handleChat(src string, m any) error {
+	msg := m.(*chatMsg)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
 	n.chatRecv = append(n.chatRecv, ChatData{
-		Source: pkt.Source,
-		Time:   time.Now(),
+		Source: src,
+		Dest:   n.name,
+		Time:   n.clock.Now(),
 		Text:   msg.Text,
 	})
 
@@ -33,13 +40,22 @@ func (n *node) processChat(pkt *packet, addr string) error {
 
 var errUnknown = errors.New("unknown destination")
 
-func (n *node) sendChat(dest string, text string) error {
-	addr := n.resolveRelayAddr(dest)
-	if addr == "" {
-		return errUnknown
-	}
-	pkt := n.newPacket(dest, &chatMsg{
+func (n *node) sendChat(dest string, text string, opts ...SendOption) (string, error) {
+	msg := &chatMsg{
 		Text: text,
+	}
+	id, err := n.sendReliable(dest, msg.Type(), msg, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	n.chatSent = append(n.chatSent, ChatData{
+		Id:     id,
+		Source: n.name,
+		Dest:   dest,
+		Time:   n.clock.Now(),
+		Text:   text,
 	})
-	return n.sendPacket(addr, pkt)
+
+	return id, nil
 }
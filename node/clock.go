@@ -0,0 +1,33 @@
+package node
+
+import (
+	"context"
+	"time"
+)
+
+// Clock drives timers of node background loops and all timestamps,
+// so tests may replace it with manually advanced one
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SettlingClock is optional extension of Clock for deterministic tests, which fires
+// next timer only after all node goroutines wait for timer or packet. Node reports
+// goroutines it starts and stops with Busy, and waits with Sleep, so clock accounts
+// both wake up by timer and by stop
+type SettlingClock interface {
+	Clock
+	Busy(delta int)
+	Sleep(ctx context.Context, d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,237 @@
+package node
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+const e2eQueueCap = 64 // packets waiting for key exchange, per destination
+const e2eQueueExpire = 10 * time.Second
+
+var ErrDecrypt = errors.New("unable to decrypt payload")
+
+type e2eSession struct {
+	peer []byte // peer X25519 public key
+	aead cipher.AEAD
+}
+
+type e2eQueue struct {
+	pkts    []*packet
+	started time.Time
+}
+
+type kexReqMsg struct {
+	Pub []byte
+}
+
+func (msg *kexReqMsg) Type() string {
+	return "kexreq"
+}
+
+type kexRespMsg struct {
+	Pub []byte
+}
+
+func (msg *kexRespMsg) Type() string {
+	return "kexresp"
+}
+
+func (n *node) processKexReq(pkt *packet, addr string) error {
+	msg := &kexReqMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	err = n.setSession(pkt.Source, msg.Pub)
+	if err != nil {
+		return err
+	}
+
+	relayAddr := n.resolveRelayAddr(pkt.Source)
+	if relayAddr == "" {
+		return errUnknown
+	}
+	return n.sendPacket(relayAddr, n.newPacket(pkt.Source, &kexRespMsg{
+		Pub: n.ecdhPriv.PublicKey().Bytes(),
+	}))
+}
+
+func (n *node) processKexResp(pkt *packet, addr string) error {
+	msg := &kexRespMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	return n.setSession(pkt.Source, msg.Pub)
+}
+
+// kex packets are signed by identity key, so relays are unable to substitute public key
+func (n *node) setSession(name string, pub []byte) error {
+	s, ok := n.sessions[name]
+	if ok && string(s.peer) == string(pub) {
+		return nil
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return badPayload(err)
+	}
+	shared, err := n.ecdhPriv.ECDH(peer)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	// both sides derive same key, so simultaneous exchange is fine
+	own := n.ecdhPriv.PublicKey().Bytes()
+	h := sha256.New()
+	h.Write([]byte("natalie e2e"))
+	h.Write(shared)
+	if string(own) < string(pub) {
+		h.Write(own)
+		h.Write(pub)
+	} else {
+		h.Write(pub)
+		h.Write(own)
+	}
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	s = &e2eSession{peer: pub, aead: aead}
+	n.sessions[name] = s
+
+	// peer key changed, reliable packets sealed with old key are useless
+	for _, out := range n.outgoing {
+		if out.pkt.Destination == name && out.pkt.Enc {
+			n.seal(s, out.pkt)
+		}
+	}
+
+	queue, ok := n.e2eQueue[name]
+	if ok {
+		delete(n.e2eQueue, name)
+		for _, pkt := range queue.pkts {
+			n.sendSealed(pkt) // TODO: handle error
+		}
+	}
+
+	return nil
+}
+
+func (n *node) requestKex(dest string) error {
+	now := n.clock.Now()
+	if now.Sub(n.kexSent[dest]) < retransmitTimeout {
+		return nil // in progress
+	}
+	n.kexSent[dest] = now
+
+	relayAddr := n.resolveRelayAddr(dest)
+	if relayAddr == "" {
+		return errUnknown
+	}
+	return n.sendPacket(relayAddr, n.newPacket(dest, &kexReqMsg{
+		Pub: n.ecdhPriv.PublicKey().Bytes(),
+	}))
+}
+
+// encrypt payload for destination, or queue packet until key exchange is done
+func (n *node) sendSealed(pkt *packet) error {
+	s, ok := n.sessions[pkt.Destination]
+	if !ok {
+		queue, ok := n.e2eQueue[pkt.Destination]
+		if !ok {
+			queue = &e2eQueue{started: n.clock.Now()}
+			n.e2eQueue[pkt.Destination] = queue
+		}
+		if len(queue.pkts) >= e2eQueueCap {
+			return errors.New("too many packets waiting for key exchange")
+		}
+		queue.pkts = append(queue.pkts, pkt)
+		return n.requestKex(pkt.Destination)
+	}
+
+	n.seal(s, pkt)
+
+	relayAddr := n.resolveRelayAddrFor(pkt.Destination, pkt.Id)
+	if relayAddr == "" {
+		return errUnknown
+	}
+	return n.sendPacket(relayAddr, pkt)
+}
+
+// header is authenticated, so payload can not be moved to other packet
+func e2eAdditionalData(pkt *packet) []byte {
+	return []byte(pkt.Id + "\x00" + pkt.Source + "\x00" + pkt.Destination + "\x00" + pkt.Type)
+}
+
+func (n *node) seal(s *e2eSession, pkt *packet) {
+	if pkt.plain == nil {
+		pkt.plain = pkt.Payload
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, pkt.plain, e2eAdditionalData(pkt))
+
+	payload, _ := json.Marshal(sealed) // base64 string
+	pkt.Payload = payload
+	pkt.Enc = true
+	n.signPacket(pkt)
+}
+
+// decrypt payload of packet addressed to us
+func (n *node) open(pkt *packet) error {
+	s, ok := n.sessions[pkt.Source]
+	if !ok {
+		n.requestKex(pkt.Source) // we restarted, and lost session
+		return ErrDecrypt
+	}
+
+	var sealed []byte
+	err := json.Unmarshal(pkt.Payload, &sealed)
+	if err != nil {
+		return badPayload(err)
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return badPayload(errors.New("sealed payload too short"))
+	}
+	plain, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], e2eAdditionalData(pkt))
+	if err != nil {
+		n.requestKex(pkt.Source) // peer may use our previous key
+		return ErrDecrypt
+	}
+
+	pkt.Payload = plain
+	pkt.Enc = false
+	return nil
+}
+
+// retry key exchange for queued packets, drop queue if peer does not respond
+func (n *node) checkE2EQueues(now time.Time) {
+	for dest, queue := range n.e2eQueue {
+		if now.Sub(queue.started) > e2eQueueExpire {
+			delete(n.e2eQueue, dest)
+			n.log.Println("key exchange with", dest, "failed, dropped", len(queue.pkts), "packets")
+			continue
+		}
+		n.requestKex(dest)
+	}
+}
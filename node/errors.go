@@ -0,0 +1,105 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrMalformedPacket = errors.New("malformed packet")
+	ErrUnknownType     = errors.New("unknown packet type")
+	ErrBadPayload      = errors.New("bad payload")
+	ErrTTLExpired      = errors.New("ttl expired")
+	ErrBadSignature    = errors.New("bad packet signature")
+	ErrNameConflict    = errors.New("name owned by other key")
+	ErrStalePacket     = errors.New("packet time outside of replay window")
+)
+
+// PacketError is returned by packet pipeline, when packet from addr was rejected
+type PacketError struct {
+	Addr string
+	Type string
+	Err  error
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("packet from %s, type %q: %v", e.Addr, e.Type, e.Err)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+func badPayload(err error) error {
+	return fmt.Errorf("%w: %v", ErrBadPayload, err)
+}
+
+// bad packet is garbage sent by remote side, other errors are our problems
+func isBadPacket(err error) bool {
+	return errors.Is(err, ErrMalformedPacket) || errors.Is(err, ErrUnknownType) || errors.Is(err, ErrBadPayload) ||
+		errors.Is(err, ErrBadSignature) || errors.Is(err, ErrNameConflict)
+}
+
+type BadPacketStats struct {
+	Count       uint      `json:"count"`
+	LastError   string    `json:"last_error"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+const badPacketsCap = 1024               // tracked addresses, garbage may come from many spoofed ones
+const badPacketExpire = 10 * time.Minute // not banned address is forgotten after quiet period
+
+type badPacketState struct {
+	BadPacketStats
+	strikes int       // bad packets since last ban
+	last    time.Time // of last bad packet
+}
+
+// record bad packet from addr, ban it if policy enabled and limit reached
+func (n *node) recordBadPacket(addr string, err error) {
+	now := n.clock.Now()
+	state, ok := n.badPackets[addr]
+	if !ok {
+		if len(n.badPackets) >= badPacketsCap {
+			n.pruneBadPackets(now)
+		}
+		state = &badPacketState{}
+		n.badPackets[addr] = state
+	}
+	state.Count++
+	state.LastError = err.Error()
+	state.strikes++
+	state.last = now
+
+	if n.banThreshold > 0 && state.strikes >= n.banThreshold {
+		state.strikes = 0
+		state.BannedUntil = now.Add(n.banDuration)
+		n.log.Println("banned", addr, "until", state.BannedUntil)
+	}
+}
+
+// forget expired not banned addresses, if still full, oldest not banned one
+func (n *node) pruneBadPackets(now time.Time) {
+	oldest := ""
+	for addr, state := range n.badPackets {
+		if now.Before(state.BannedUntil) {
+			continue
+		}
+		if now.Sub(state.last) > badPacketExpire {
+			delete(n.badPackets, addr)
+			continue
+		}
+		if oldest == "" || state.last.Before(n.badPackets[oldest].last) {
+			oldest = addr
+		}
+	}
+	if len(n.badPackets) >= badPacketsCap && oldest != "" {
+		delete(n.badPackets, oldest)
+	}
+}
+
+func (n *node) isBanned(addr string) bool {
+	state, ok := n.badPackets[addr]
+	return ok && n.clock.Now().Before(state.BannedUntil)
+}
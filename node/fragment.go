@@ -0,0 +1,269 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMTU          = 1200 // datagram size safe on most paths, including ipv6 minimum
+	minMTU              = 576
+	maxMTU              = 65507 // max udp payload
+	maxMessageSize      = 1 << 20
+	fragmentTimeout     = 10 * time.Second     // partial message is dropped, if no fragment arrives for
+	fragmentBurst       = 16                   // fragments sent at once, so receive buffer of peer is not overrun
+	fragmentPace        = 2 * time.Millisecond // between bursts
+	maxPartialPerSender = 16                   // messages in reassembly
+	maxBytesPerSender   = 2 * maxMessageSize
+)
+
+var ErrFragmentLimit = errors.New("fragment buffer limit exceeded")
+
+// part of packet, which does not fit link mtu, relays forward fragments
+// as any other packet, destination reassembles and handles original packet
+type fragmentMsg struct {
+	Group string // hash of fragmented data, so retransmissions fill same reassembly
+	Index uint16
+	Count uint16
+	Data  []byte
+}
+
+func (msg *fragmentMsg) Type() string {
+	return "fragment"
+}
+
+type reassembly struct {
+	parts   [][]byte
+	missing int
+	size    int
+	updated time.Time // last new fragment
+	done    bool      // kept until timeout, so late retransmitted fragments are ignored
+}
+
+// negotiated mtu of link to neighbor at addr, our own for others
+func (n *node) mtuFor(addr string) int {
+	name, ok := n.name2addr.GetByValue(addr)
+	if !ok {
+		return n.mtu
+	}
+	if mtu, ok := n.linkMTU[name]; ok {
+		return mtu
+	}
+	return n.mtu
+}
+
+// peer advertises largest datagram it accepts, 0 from nodes without fragmentation
+func (n *node) negotiateMTU(name string, mtu int) {
+	if mtu <= 0 || mtu > n.mtu {
+		mtu = n.mtu
+	}
+	if mtu < minMTU {
+		mtu = minMTU
+	}
+	n.linkMTU[name] = mtu
+}
+
+// split encoded packet into fragments fitting mtu, all are sent to addr,
+// first burst at once, others paced in background
+func (n *node) sendFragments(addr string, pkt *packet, mtu int) error {
+	// inner packet is decoded only by destination, json if we do not know its version
+	data, err := encodeWire(pkt, n.wire[pkt.Destination])
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("packet of %d bytes exceeds limit %d", len(data), maxMessageSize)
+	}
+
+	// overhead of fragment without data, with largest index and count
+	wire := n.wireFor(addr)
+	empty, err := encodeWire(n.newPacket(pkt.Destination, &fragmentMsg{
+		Group: fragmentGroup(data, 0),
+		Index: 0xffff,
+		Count: 0xffff,
+	}), wire)
+	if err != nil {
+		return err
+	}
+	chunk := (mtu - len(empty)) / 4 * 3 // data is base64 in json payload
+	if chunk <= 0 {
+		return fmt.Errorf("mtu %d too small for fragment", mtu)
+	}
+
+	count := (len(data) + chunk - 1) / chunk
+	group := fragmentGroup(data, chunk)
+	frags := make([][]byte, count)
+	for i := range frags {
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		frags[i], err = encodeWire(n.newPacket(pkt.Destination, &fragmentMsg{
+			Group: group,
+			Index: uint16(i),
+			Count: uint16(count),
+			Data:  data[i*chunk : end],
+		}), wire)
+		if err != nil {
+			return err
+		}
+	}
+	n.stats.Fragmented++
+
+	burst := frags
+	if len(burst) > fragmentBurst {
+		burst = burst[:fragmentBurst]
+	}
+	for _, frag := range burst {
+		_, err := n.transport.WriteTo(frag, addr)
+		if err != nil {
+			return err
+		}
+	}
+	frags = frags[len(burst):]
+	if len(frags) == 0 {
+		return nil
+	}
+
+	transport := n.transport
+	n.spawn(func() {
+		for len(frags) > 0 {
+			if !n.sleep(fragmentPace) {
+				return
+			}
+			burst := frags
+			if len(burst) > fragmentBurst {
+				burst = burst[:fragmentBurst]
+			}
+			for _, frag := range burst {
+				_, err := transport.WriteTo(frag, addr)
+				if err != nil {
+					return // lost fragments are sent again with retransmission
+				}
+			}
+			frags = frags[len(burst):]
+		}
+	})
+	return nil
+}
+
+// same packet split same way gets same group, also when sent by other relay
+func fragmentGroup(data []byte, chunk int) string {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(chunk)))
+	h.Write(data)
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil)[:12])
+}
+
+func (n *node) processFragment(pkt *packet, addr string) error {
+	msg := &fragmentMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+	if msg.Count == 0 || msg.Index >= msg.Count || len(msg.Data) == 0 || msg.Group == "" {
+		return badPayload(errors.New("bad fragment index"))
+	}
+
+	now := n.clock.Now()
+	n.purgeFragments(now)
+
+	partial, ok := n.fragments[pkt.Source]
+	if !ok {
+		partial = make(map[string]*reassembly)
+		n.fragments[pkt.Source] = partial
+	}
+	r, ok := partial[msg.Group]
+	if ok && r.done {
+		return nil // late duplicate
+	}
+	if !ok {
+		if countPending(partial) >= maxPartialPerSender {
+			n.stats.ReassemblyDropped++
+			return ErrFragmentLimit
+		}
+		r = &reassembly{
+			parts:   make([][]byte, msg.Count),
+			missing: int(msg.Count),
+			updated: now,
+		}
+		partial[msg.Group] = r
+	}
+	if int(msg.Count) != len(r.parts) {
+		return badPayload(errors.New("fragment count changed"))
+	}
+	if r.parts[msg.Index] != nil {
+		return nil // duplicate
+	}
+	if r.size+len(msg.Data) > maxMessageSize || n.fragmentBytes[pkt.Source]+len(msg.Data) > maxBytesPerSender {
+		n.dropReassembly(pkt.Source, msg.Group)
+		n.stats.ReassemblyDropped++
+		return ErrFragmentLimit
+	}
+	r.parts[msg.Index] = msg.Data
+	r.updated = now
+	r.missing--
+	r.size += len(msg.Data)
+	n.fragmentBytes[pkt.Source] += len(msg.Data)
+	if r.missing > 0 {
+		return nil
+	}
+
+	data := make([]byte, 0, r.size)
+	for _, part := range r.parts {
+		data = append(data, part...)
+	}
+	n.fragmentBytes[pkt.Source] -= r.size
+	r.parts, r.size, r.done = nil, 0, true
+	n.stats.Reassembled++
+
+	// original packet is verified and handled, as if it came whole
+	err = n.handlePacket(data, addr)
+	var perr *PacketError
+	if errors.As(err, &perr) {
+		return fmt.Errorf("reassembled %q: %w", perr.Type, perr.Err)
+	}
+	return err
+}
+
+func countPending(partial map[string]*reassembly) int {
+	count := 0
+	for _, r := range partial {
+		if !r.done {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *node) dropReassembly(source string, group string) {
+	partial := n.fragments[source]
+	r, ok := partial[group]
+	if !ok {
+		return
+	}
+	n.fragmentBytes[source] -= r.size
+	delete(partial, group)
+	if len(partial) == 0 {
+		delete(n.fragments, source)
+		delete(n.fragmentBytes, source)
+	}
+}
+
+func (n *node) purgeFragments(now time.Time) {
+	for source, partial := range n.fragments {
+		for group, r := range partial {
+			if now.Sub(r.updated) > fragmentTimeout {
+				n.dropReassembly(source, group)
+				if !r.done {
+					n.stats.ReassemblyDropped++
+				}
+			}
+		}
+	}
+}
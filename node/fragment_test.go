@@ -0,0 +1,46 @@
+package node
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLargeChatOverUDP(t *testing.T) {
+	skipWithoutIPv6(t)
+	a := newUDPNode(t, "a")
+	b := newUDPNode(t, "b")
+	a.DirectHandshake(loopbackAddr(t, b, "::1"))
+	waitFor(t, "neighbors", func() bool {
+		_, ok := b.Neighbors()["a"]
+		return ok && a.Neighbors()["b"] != ""
+	})
+
+	for _, size := range []int{150 << 10, 500 << 10} {
+		text := strings.Repeat("x", size)
+		id, err := a.SendChat("b", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for a.DeliveryStatus(id) != DeliveryDelivered {
+			if time.Now().After(deadline) {
+				t.Fatalf("chat of %d bytes is %s", size, a.DeliveryStatus(id))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		chat := b.Chat()
+		if got := chat[len(chat)-1]; got.Source != "a" || got.Text != text {
+			t.Fatalf("chat of %d bytes received as %d bytes", size, len(got.Text))
+		}
+	}
+
+	// fragments do not push other ids out of seen
+	nb := b.(*node)
+	nb.mu.Lock()
+	seen := nb.seen.Len()
+	nb.mu.Unlock()
+	if seen > 20 {
+		t.Fatalf("%d ids in seen", seen)
+	}
+}
@@ -0,0 +1,145 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Handler describes custom packet type, see RegisterHandler
+type Handler struct {
+	// Routable packets may come from any node through relays,
+	// otherwise they are accepted only directly from neighbors
+	Routable bool
+	// Decode converts raw payload into message passed to Handle
+	Decode func(payload []byte) (any, error)
+	// Handle is called from read loop without node lock held, so it may call Node methods,
+	// except Stop, which waits for read loop to exit, call it from other goroutine
+	Handle func(src string, msg any) error
+}
+
+type handler struct {
+	onlyLocal bool // accepted only from neighbors
+	handshake bool // accepted from unknown addresses, before neighbor is established
+	unseen    bool // id is not remembered, reassembled packet is checked instead, so fragments do not flush seen
+	process   func(pkt *packet, addr string) error
+}
+
+func (n *node) registerBuiltinHandlers() {
+	n.handlers["handshakereq"] = handler{handshake: true, process: n.processHandshakeReq}
+	n.handlers["handshakeresp"] = handler{handshake: true, process: n.processHandshakeResp}
+	n.handlers["traversalreq"] = handler{handshake: true, process: n.processTraversalReq}
+	n.handlers["traversalresp"] = handler{handshake: true, process: n.processTraversalResp}
+	n.handlers["traversalsync"] = handler{process: n.processTraversalSync}
+	n.handlers["keepalive"] = handler{onlyLocal: true, process: n.processKeepAlive}
+	n.handlers["goodbye"] = handler{onlyLocal: true, process: n.processGoodbye}
+	n.handlers["routingstatus"] = handler{onlyLocal: true, process: n.processRoutingStatus}
+	n.handlers["routingupdate"] = handler{onlyLocal: true, process: n.processRoutingUpdate}
+	n.handlers["relayallocreq"] = handler{onlyLocal: true, process: n.processRelayAllocReq}
+	n.handlers["relayallocresp"] = handler{onlyLocal: true, process: n.processRelayAllocResp}
+	n.handlers["relayfree"] = handler{onlyLocal: true, process: n.processRelayFree}
+	n.handlers["natprobereq"] = handler{onlyLocal: true, process: n.processNATProbeReq}
+	n.handlers["natproberesp"] = handler{onlyLocal: true, process: n.processNATProbeResp}
+	n.handlers["natprobefwd"] = handler{onlyLocal: true, process: n.processNATProbeFwd}
+	n.handlers["natprobe"] = handler{handshake: true, process: n.processNATProbe}
+	n.handlers["natsamplereq"] = handler{onlyLocal: true, process: n.processNATSampleReq}
+	n.handlers["natsampleport"] = handler{onlyLocal: true, process: n.processNATSamplePort}
+	n.handlers["ack"] = handler{process: n.processAck}
+	n.handlers["kexreq"] = handler{process: n.processKexReq}
+	n.handlers["kexresp"] = handler{process: n.processKexResp}
+	n.handlers["fragment"] = handler{unseen: true, process: n.processFragment}
+
+	n.registerHandler("chat", Handler{
+		Routable: true,
+		Decode:   decodeChat,
+		Handle:   n.handleChat,
+	})
+}
+
+func (n *node) RegisterHandler(typ string, h Handler) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.registerHandler(typ, h)
+}
+
+func (n *node) registerHandler(typ string, h Handler) error {
+	if typ == "" {
+		return errors.New("empty packet type")
+	}
+	if h.Decode == nil || h.Handle == nil {
+		return errors.New("handler without Decode or Handle")
+	}
+	if _, ok := n.handlers[typ]; ok {
+		return errors.New("packet type already registered: " + typ)
+	}
+
+	n.handlers[typ] = handler{
+		onlyLocal: !h.Routable,
+		process: func(pkt *packet, addr string) error {
+			msg, err := h.Decode(pkt.Payload)
+			if err != nil {
+				return badPayload(err)
+			}
+			src := pkt.Source
+			// user code may lock node, so call it after read loop unlocks
+			n.deferred = append(n.deferred, func() {
+				err := h.Handle(src, msg)
+				if err != nil {
+					n.log.Println(&PacketError{Addr: addr, Type: typ, Err: err})
+				}
+			})
+			return nil
+		},
+	}
+	return nil
+}
+
+func (n *node) Send(dest string, typ string, msg any, opts ...SendOption) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.send(dest, typ, msg, opts...)
+}
+
+// send message to dest, directly if neighbor, otherwise through relay,
+// payload is encrypted, so relays can not read it
+func (n *node) send(dest string, typ string, msg any, opts ...SendOption) error {
+	h, ok := n.handlers[typ]
+	if ok && h.onlyLocal {
+		if _, neighbor := n.name2addr.GetByKey(dest); !neighbor {
+			return errors.New("packet type allowed only between neighbors: " + typ)
+		}
+	}
+
+	addr := n.resolveRelayAddr(dest)
+	if addr == "" {
+		return errUnknown
+	}
+	pkt, err := n.encodePacket(dest, typ, msg, opts...)
+	if err != nil {
+		return err
+	}
+	return n.sendSealed(pkt)
+}
+
+func (n *node) encodePacket(dest string, typ string, msg any, opts ...SendOption) (*packet, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	pkt := &packet{
+		Id:          randomID(16),
+		Source:      n.name,
+		Destination: dest,
+		Type:        typ,
+		Payload:     payload,
+		TTL:         n.defaultTTL,
+		Time:        n.clock.Now().UnixMilli(),
+	}
+	for _, opt := range opts {
+		opt(pkt)
+	}
+	if pkt.TTL == 0 {
+		pkt.TTL = n.defaultTTL // WithTTL(0), otherwise relays would apply their own default
+	}
+	n.signPacket(pkt)
+	return pkt, nil
+}
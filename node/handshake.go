@@ -7,6 +7,8 @@ import (
 
 type handshakeReqMsg struct {
 	ServerAddr string
+	Wire       uint8 // newest binary wire version sender decodes, 0 for json only
+	MTU        int   // largest datagram sender accepts
 }
 
 func (msg *handshakeReqMsg) Type() string {
@@ -15,6 +17,8 @@ func (msg *handshakeReqMsg) Type() string {
 
 type handshakeRespMsg struct {
 	ClientAddr string
+	Wire       uint8
+	MTU        int
 }
 
 func (msg *handshakeRespMsg) Type() string {
@@ -25,7 +29,7 @@ func (n *node) processHandshakeReq(pkt *packet, addr string) error {
 	msg := &handshakeReqMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	if pkt.Source == n.name {
@@ -33,13 +37,22 @@ func (n *node) processHandshakeReq(pkt *packet, addr string) error {
 		return nil
 	}
 
-	n.name2addr.Set(pkt.Source, addr)
+	n.checkClockSkew(pkt)
+	n.setNeighborAddr(pkt.Source, addr)
 	n.knownAddr.Set(msg.ServerAddr)
+	// before response, peer may have restarted with older version
+	n.negotiateWire(pkt.Source, msg.Wire)
+	n.negotiateMTU(pkt.Source, msg.MTU)
 
 	respPkt := n.newPacket(pkt.Source, &handshakeRespMsg{
 		ClientAddr: addr,
+		Wire:       n.wireVersion,
+		MTU:        n.mtu,
 	})
 	n.sendPacket(addr, respPkt)
+	n.sendKeepAlive(pkt.Source) // measure rtt early
+	n.nominatePair(pkt.Source, msg.ServerAddr, addr)
+	n.traversalDone(pkt.Source)
 
 	return n.routingNeighborUpdate()
 }
@@ -48,7 +61,7 @@ func (n *node) processHandshakeResp(pkt *packet, addr string) error {
 	msg := &handshakeRespMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	if pkt.Source == n.name {
@@ -56,8 +69,14 @@ func (n *node) processHandshakeResp(pkt *packet, addr string) error {
 		return nil
 	}
 
-	n.name2addr.Set(pkt.Source, addr)
+	n.checkClockSkew(pkt)
+	n.setNeighborAddr(pkt.Source, addr)
 	n.knownAddr.Set(msg.ClientAddr)
+	n.negotiateWire(pkt.Source, msg.Wire)
+	n.negotiateMTU(pkt.Source, msg.MTU)
+	n.sendKeepAlive(pkt.Source) // measure rtt early
+	n.nominatePair(pkt.Source, msg.ClientAddr, addr)
+	n.traversalDone(pkt.Source)
 
 	n.routingNeighborUpdate()
 
@@ -67,6 +86,19 @@ func (n *node) processHandshakeResp(pkt *packet, addr string) error {
 func (n *node) directHandshake(addr string) error {
 	pkt := n.newPacket(directDestName, &handshakeReqMsg{
 		ServerAddr: addr,
+		Wire:       n.wireVersion,
+		MTU:        n.mtu,
 	})
 	return n.sendPacket(addr, pkt)
 }
+
+// ipv6 path is kept, when peer is reachable over both families,
+// otherwise latest handshake address wins
+func (n *node) setNeighborAddr(name string, addr string) {
+	old, ok := n.name2addr.GetByKey(name)
+	if ok && old != addr && isIPv6(old) && !isIPv6(addr) {
+		return
+	}
+	n.name2addr.DeleteByKey(name)
+	n.name2addr.Set(name, addr)
+}
@@ -0,0 +1,156 @@
+package node
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pavelverigo/natalie/internal/bimap"
+)
+
+func newUDPNode(t *testing.T, name string, opts ...Option) Node {
+	t.Helper()
+	n, err := New(name, 0, log.New(io.Discard, "", 0), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Stop() })
+	return n
+}
+
+// address of node on loopback of given family, "::1" or "127.0.0.1"
+func loopbackAddr(t *testing.T, n Node, host string) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(n.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no ipv6 loopback:", err)
+	}
+	conn.Close()
+}
+
+func TestHandshakeIPv6Loopback(t *testing.T) {
+	skipWithoutIPv6(t)
+	a := newUDPNode(t, "a")
+	b := newUDPNode(t, "b")
+
+	bAddr := loopbackAddr(t, b, "::1")
+	a.DirectHandshake(bAddr)
+	waitFor(t, "neighbors over ipv6", func() bool {
+		return a.Neighbors()["b"] == bAddr && isIPv6(b.Neighbors()["a"])
+	})
+
+	// ipv4 handshake later does not replace ipv6 address
+	a.DirectHandshake(loopbackAddr(t, b, "127.0.0.1"))
+	time.Sleep(200 * time.Millisecond)
+	if addr := a.Neighbors()["b"]; addr != bAddr {
+		t.Fatalf("neighbor address %s, want %s", addr, bAddr)
+	}
+	if addr := b.Neighbors()["a"]; !isIPv6(addr) {
+		t.Fatalf("neighbor address %s, want ipv6", addr)
+	}
+}
+
+func TestHandshakeUpgradesToIPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+	a := newUDPNode(t, "a")
+	b := newUDPNode(t, "b")
+
+	a.DirectHandshake(loopbackAddr(t, b, "127.0.0.1"))
+	waitFor(t, "neighbors over ipv4", func() bool {
+		addr, ok := a.Neighbors()["b"]
+		return ok && !isIPv6(addr)
+	})
+
+	bAddr := loopbackAddr(t, b, "::1")
+	a.DirectHandshake(bAddr)
+	waitFor(t, "upgrade to ipv6", func() bool {
+		return a.Neighbors()["b"] == bAddr && isIPv6(b.Neighbors()["a"])
+	})
+}
+
+func TestSetNeighborAddrPrefersIPv6(t *testing.T) {
+	n := &node{name2addr: bimap.New[string, string](0)}
+	n.setNeighborAddr("b", "127.0.0.1:1000")
+	n.setNeighborAddr("b", "[::1]:1000")
+	n.setNeighborAddr("b", "127.0.0.1:1000")
+	if addr, _ := n.name2addr.GetByKey("b"); addr != "[::1]:1000" {
+		t.Fatalf("address %s, want [::1]:1000", addr)
+	}
+	n.setNeighborAddr("b", "[::1]:2000")
+	if addr, _ := n.name2addr.GetByKey("b"); addr != "[::1]:2000" {
+		t.Fatalf("address %s, want [::1]:2000", addr)
+	}
+}
+
+type skewedClock struct {
+	realClock
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return time.Now().Add(c.skew)
+}
+
+func TestHandshakeWithSkewedClock(t *testing.T) {
+	var logs strings.Builder
+	var mu sync.Mutex
+	a := newUDPNode(t, "a", WithClock(skewedClock{skew: 5 * time.Minute}))
+	b, err := New("b", 0, log.New(lockedWriter{&mu, &logs}, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Stop() })
+
+	a.DirectHandshake(loopbackAddr(t, b, "127.0.0.1"))
+	waitFor(t, "neighbors", func() bool {
+		_, ok := b.Neighbors()["a"]
+		return ok && a.Neighbors()["b"] != ""
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(logs.String(), "clock of a differs") {
+		t.Fatalf("no clock skew in log:\n%s", logs.String())
+	}
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,133 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const keyBindingExpire = stateMaxAge // live node reissues signed state more often
+
+// load identity from file, or generate new one and save it there
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		return priv, os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// signed part of packet, ttl is excluded, because relays change it
+func packetSignData(pkt *packet) []byte {
+	data := []byte("natalie packet")
+	for _, field := range [][]byte{[]byte(pkt.Id), []byte(pkt.Source), []byte(pkt.Destination), []byte(pkt.Type), pkt.Payload} {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	var flags byte
+	if pkt.Ack {
+		flags |= 1
+	}
+	if pkt.Enc {
+		flags |= 2
+	}
+	data = binary.AppendVarint(data, pkt.Time)
+	return append(data, flags)
+}
+
+func (n *node) signPacket(pkt *packet) {
+	pkt.Key = n.pub
+	pkt.Sig = ed25519.Sign(n.priv, packetSignData(pkt))
+}
+
+// check signature, and that source name is owned by packet key
+func (n *node) verifyPacket(pkt *packet) error {
+	if len(pkt.Key) != ed25519.PublicKeySize || !ed25519.Verify(pkt.Key, packetSignData(pkt), pkt.Sig) {
+		return ErrBadSignature
+	}
+	return n.bindKey(pkt.Source, pkt.Key)
+}
+
+// bind name to key on first use, later packets must use same key, until name
+// is silent for keyBindingExpire, then name may be taken by new key (node restarted without identity file)
+func (n *node) bindKey(name string, key ed25519.PublicKey) error {
+	if name == n.name && !n.pub.Equal(key) {
+		return fmt.Errorf("%w: someone else uses our name %s", ErrNameConflict, name)
+	}
+	now := n.clock.Now()
+	bound, ok := n.name2key[name]
+	if ok && !bound.Equal(key) {
+		_, neighbor := n.name2addr.GetByKey(name)
+		if neighbor || now.Sub(n.keyUsed[name]) < keyBindingExpire {
+			return fmt.Errorf("%w: %s is bound to other key", ErrNameConflict, name)
+		}
+		n.log.Println("rebind silent name", name, "to new key")
+		delete(n.sessions, name)
+		ok = false
+	}
+	if !ok {
+		n.name2key[name] = key
+	}
+	n.keyUsed[name] = now
+	return nil
+}
+
+func stateSignData(name string, state neighborState) []byte {
+	data := []byte("natalie state")
+	data = binary.AppendUvarint(data, uint64(len(name)))
+	data = append(data, name...)
+	data = binary.AppendUvarint(data, state.Version.Epoch)
+	data = binary.AppendUvarint(data, state.Version.Seq)
+	for _, neighbor := range state.Neighbors {
+		data = binary.AppendUvarint(data, uint64(len(neighbor)))
+		data = append(data, neighbor...)
+	}
+	for _, cost := range state.Costs {
+		data = binary.AppendUvarint(data, cost)
+	}
+	return data
+}
+
+func (n *node) signState(state neighborState) neighborState {
+	state.Key = n.pub
+	state.Sig = ed25519.Sign(n.priv, stateSignData(n.name, state))
+	return state
+}
+
+// check that state is signed by origin, which owns the name
+func (n *node) verifyState(name string, state neighborState) error {
+	if len(state.Key) != ed25519.PublicKeySize || !ed25519.Verify(state.Key, stateSignData(name, state), state.Sig) {
+		return fmt.Errorf("%w: state of %s", ErrBadSignature, name)
+	}
+	return n.bindKey(name, state.Key)
+}
@@ -2,11 +2,13 @@ package node
 
 import (
 	"encoding/json"
-	"log"
 	"time"
 )
 
-type keepAliveMsg struct{}
+type keepAliveMsg struct {
+	Time  int64 // send time of request, in nanoseconds of requester clock
+	Reply bool  // echo of request, used to measure rtt
+}
 
 func (msg *keepAliveMsg) Type() string {
 	return "keepalive"
@@ -16,21 +18,89 @@ func (n *node) processKeepAlive(pkt *packet, addr string) error {
 	msg := &keepAliveMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
+	}
+
+	// time update done in recv loop
+
+	if !msg.Reply {
+		return n.sendPacket(addr, n.newPacket(pkt.Source, &keepAliveMsg{
+			Time:  msg.Time,
+			Reply: true,
+		}))
+	}
+
+	delete(n.keepAliveWait, pkt.Source)
+	delete(n.suspected, pkt.Source)
+
+	sample := time.Duration(n.clock.Now().UnixNano() - msg.Time)
+	if sample < 0 {
+		return nil
+	}
+	n.updateRTT(pkt.Source, sample)
+
+	return nil
+}
+
+// neighbor is suspected dead before it is removed, so traffic can fail over sooner
+func (n *node) neighborAlive(name string, now time.Time) bool {
+	t, ok := n.keepAliveTime[name]
+	return ok && !n.suspected[name] && now.Sub(t) <= neighborSuspectTimeout
+}
+
+// mark neighbor suspect and probe it at once, reply clears suspicion
+func (n *node) suspectNeighbor(name string) {
+	if _, ok := n.name2addr.GetByKey(name); !ok || n.suspected[name] {
+		return
+	}
+	n.log.Println("neighbor suspected", name)
+	n.suspected[name] = true
+	n.sendKeepAlive(name)
+}
+
+func (n *node) sendKeepAlive(name string) error {
+	addr, _ := n.name2addr.GetByKey(name)
+	n.keepAliveWait[name] = true
+	return n.sendPacket(addr, n.newPacket(name, &keepAliveMsg{
+		Time: n.clock.Now().UnixNano(),
+	}))
+}
+
+type goodbyeMsg struct{}
+
+func (msg *goodbyeMsg) Type() string {
+	return "goodbye"
+}
+
+func (n *node) processGoodbye(pkt *packet, addr string) error {
+	msg := &goodbyeMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
 	}
 
-	// nothing to do, time update done in recv loop
+	n.removeNeighbor(pkt.Source)
 
 	return nil
 }
 
+// notify all neighbors that we are leaving, so they can drop us without waiting for timeout
+func (n *node) sendGoodbye() {
+	for _, name := range n.name2addr.Keys() {
+		addr, _ := n.name2addr.GetByKey(name)
+		n.sendPacket(addr, n.newPacket(name, &goodbyeMsg{}))
+	}
+}
+
 func (n *node) keepAliveLoop() {
 	for {
-		time.Sleep(keepAliveInterval)
+		if !n.sleep(keepAliveInterval) {
+			return
+		}
 
 		n.mu.Lock()
 
-		now := time.Now()
+		now := n.clock.Now()
 		for _, name := range n.name2addr.Keys() {
 			// check if neighbor, should be deleted
 			prev := n.keepAliveTime[name]
@@ -39,9 +109,13 @@ func (n *node) keepAliveLoop() {
 				continue
 			}
 
+			// previous keep alive was not answered
+			if n.keepAliveWait[name] {
+				n.suspected[name] = true
+			}
+
 			// send keep alive to neighbor
-			addr, _ := n.name2addr.GetByKey(name)
-			n.sendPacket(addr, n.newPacket(name, &keepAliveMsg{}))
+			n.sendKeepAlive(name)
 		}
 
 		n.mu.Unlock()
@@ -0,0 +1,389 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+const natProbeTimeout = 2 * time.Second
+const natProbeReflectors = 4
+const natProbedCap = 1024
+
+var errNoAltPort = errors.New("transport unable to send from other port")
+
+type NATType string
+
+const (
+	NATUnknown        NATType = "unknown"
+	NATNone           NATType = "none" // public address is local address
+	NATFullCone       NATType = "full-cone"
+	NATRestricted     NATType = "restricted"      // filters by remote ip
+	NATPortRestricted NATType = "port-restricted" // filters by remote ip and port
+	NATSymmetric      NATType = "symmetric"       // new mapping for every remote address
+)
+
+type NATInfo struct {
+	Type    NATType           `json:"type"`
+	Mapped  map[string]string `json:"mapped"` // our address seen by each reflector
+	Checked time.Time         `json:"checked"`
+}
+
+// probe in progress
+type natProbe struct {
+	nonce      string
+	mapped     map[string]string // by reflector name
+	forwarders map[string]bool   // reflectors, which are asked for other probe once they report our address
+	other      map[string]bool   // unsolicited probe from node we never contacted, by address family
+	altPort    map[string]bool   // probe from reflector ip, but other port, by address family
+}
+
+type natProbeReqMsg struct {
+	Nonce   string
+	Other   bool     // ask one of reflector neighbors to probe us
+	Target  string   // of other probe, our address reported by reflector, it must match
+	AltPort bool     // probe us from other port
+	Exclude []string // addresses we already contacted
+}
+
+func (msg *natProbeReqMsg) Type() string {
+	return "natprobereq"
+}
+
+type natProbeRespMsg struct {
+	Nonce string
+	Addr  string // as reflector sees us
+}
+
+func (msg *natProbeRespMsg) Type() string {
+	return "natproberesp"
+}
+
+// signed request is forwarded, so target is chosen by requester and checked by reflector,
+// neither of them alone makes us send probe to arbitrary address
+type natProbeFwdMsg struct {
+	Request *packet
+}
+
+func (msg *natProbeFwdMsg) Type() string {
+	return "natprobefwd"
+}
+
+type natProbeMsg struct {
+	Nonce string
+	Kind  string // "other" or "altport"
+}
+
+func (msg *natProbeMsg) Type() string {
+	return "natprobe"
+}
+
+func (n *node) processNATProbeReq(pkt *packet, addr string) error {
+	msg := &natProbeReqMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	err = n.sendPacket(addr, n.newPacket(pkt.Source, &natProbeRespMsg{
+		Nonce: msg.Nonce,
+		Addr:  addr,
+	}))
+	if err != nil {
+		return err
+	}
+
+	if msg.AltPort {
+		err = n.sendFromAltPort(addr, n.newPacket(pkt.Source, &natProbeMsg{
+			Nonce: msg.Nonce,
+			Kind:  "altport",
+		}))
+		if err != nil {
+			n.log.Println("nat probe from other port:", err)
+		}
+	}
+
+	if msg.Other && msg.Target == addr {
+		exclude := make(map[string]bool, len(msg.Exclude))
+		for _, a := range msg.Exclude {
+			exclude[a] = true
+		}
+		for _, name := range n.name2addr.Keys() {
+			neighborAddr, _ := n.name2addr.GetByKey(name)
+			if name == pkt.Source || exclude[neighborAddr] {
+				continue
+			}
+			return n.sendPacket(neighborAddr, n.newPacket(name, &natProbeFwdMsg{
+				Request: pkt,
+			}))
+		}
+	}
+
+	return nil
+}
+
+func (n *node) processNATProbeFwd(pkt *packet, addr string) error {
+	msg := &natProbeFwdMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+	req := msg.Request
+	if req == nil || req.Type != "natprobereq" || req.Destination != pkt.Source || req.Source == pkt.Source {
+		return badPayload(errors.New("forwarded request is not nat probe request to forwarder"))
+	}
+	err = n.verifyPacket(req)
+	if err != nil {
+		return err
+	}
+	err = checkPacketTime(req, n.clock.Now())
+	if err != nil {
+		return err
+	}
+	reqMsg := &natProbeReqMsg{}
+	err = json.Unmarshal(req.Payload, reqMsg)
+	if err != nil || !reqMsg.Other || reqMsg.Target == "" {
+		return badPayload(errors.New("forwarded request without other probe target"))
+	}
+	// forwarder must be neighbor in requester signed state, one probe per request
+	if !contains(n.nodesNeighborState[req.Source].Neighbors, pkt.Source) {
+		n.log.Println("nat probe request of", req.Source, "forwarded by", pkt.Source, "which is not its neighbor")
+		return nil
+	}
+	if !n.probedReqs.Add(req.Id, n.clock.Now()) {
+		return nil
+	}
+
+	return n.sendPacket(reqMsg.Target, n.newPacket(req.Source, &natProbeMsg{
+		Nonce: reqMsg.Nonce,
+		Kind:  "other",
+	}))
+}
+
+func (n *node) processNATProbeResp(pkt *packet, addr string) error {
+	msg := &natProbeRespMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	if s := n.portSampling; s != nil && msg.Nonce != "" {
+		for _, nonce := range s.order {
+			if nonce == msg.Nonce {
+				s.mapped[nonce] = msg.Addr
+			}
+		}
+	}
+	if n.natProbe == nil || n.natProbe.nonce != msg.Nonce {
+		return nil // late
+	}
+	n.natProbe.mapped[pkt.Source] = msg.Addr
+	n.knownAddr.Set(msg.Addr)
+
+	// now we know address reflector sees, so other probe may be sent only there
+	if n.natProbe.forwarders[pkt.Source] {
+		delete(n.natProbe.forwarders, pkt.Source)
+		return n.sendPacket(addr, n.newPacket(pkt.Source, &natProbeReqMsg{
+			Nonce:   msg.Nonce,
+			Other:   true,
+			Target:  msg.Addr,
+			Exclude: n.name2addr.Values(),
+		}))
+	}
+
+	return nil
+}
+
+func (n *node) processNATProbe(pkt *packet, addr string) error {
+	msg := &natProbeMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	if n.natProbe == nil || n.natProbe.nonce != msg.Nonce {
+		return nil
+	}
+	switch msg.Kind {
+	case "other":
+		n.natProbe.other[addrFamily(addr)] = true
+	case "altport":
+		n.natProbe.altPort[addrFamily(addr)] = true
+	}
+
+	return nil
+}
+
+// send packet from temporary socket, so receiver sees our ip, but other port
+func (n *node) sendFromAltPort(addr string, pkt *packet) error {
+	alt, ok := n.transport.(AltPortTransport)
+	if !ok {
+		return errNoAltPort
+	}
+	t, err := alt.ListenAltPort()
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	data, err := json.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	_, err = t.WriteTo(data, addr)
+	return err
+}
+
+func (n *node) DetectNAT() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.detectNAT(nil)
+}
+
+func (n *node) NAT() NATInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	info := n.nat
+	info.Mapped = copyMap(info.Mapped)
+	return info
+}
+
+// ask neighbors how they see us, result is classified after timeout,
+// then done is called with lock held
+func (n *node) detectNAT(done func()) error {
+	if n.natProbe != nil {
+		return errors.New("nat detection in progress")
+	}
+	reflectors := n.name2addr.Keys()
+	if len(reflectors) == 0 {
+		return errors.New("no neighbors to use as reflectors")
+	}
+	sort.Strings(reflectors)
+	if len(reflectors) > natProbeReflectors {
+		reflectors = reflectors[:natProbeReflectors]
+	}
+
+	// any reflector, which knows node we never contacted, may forward other probe,
+	// without such knowledge every reflector is asked
+	forwarders := make(map[string]bool, len(reflectors))
+	for _, name := range reflectors {
+		if n.hasThirdPartyNeighbor(name) {
+			forwarders[name] = true
+		}
+	}
+	if len(forwarders) == 0 {
+		for _, name := range reflectors {
+			forwarders[name] = true
+		}
+	}
+
+	probe := &natProbe{
+		nonce:      randomID(8),
+		mapped:     make(map[string]string),
+		forwarders: forwarders,
+		other:      make(map[string]bool),
+		altPort:    make(map[string]bool),
+	}
+	n.natProbe = probe
+
+	for _, name := range reflectors {
+		addr, _ := n.name2addr.GetByKey(name)
+		n.sendPacket(addr, n.newPacket(name, &natProbeReqMsg{
+			Nonce:   probe.nonce,
+			AltPort: true, // reflector transport may not support it
+		}))
+	}
+
+	n.spawn(func() {
+		if !n.sleep(natProbeTimeout) {
+			return
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.nat = NATInfo{
+			Type:    n.classifyNAT(probe),
+			Mapped:  probe.mapped,
+			Checked: n.clock.Now(),
+		}
+		n.natProbe = nil
+		if done != nil {
+			done()
+		}
+	})
+
+	return nil
+}
+
+// reflector state lists neighbor, which is not us or our neighbor
+func (n *node) hasThirdPartyNeighbor(reflector string) bool {
+	for _, name := range n.nodesNeighborState[reflector].Neighbors {
+		if _, ours := n.name2addr.GetByKey(name); !ours && name != n.name {
+			return true
+		}
+	}
+	return false
+}
+
+// each address family is classified alone, dual stack node is as restrictive as its worst family
+func (n *node) classifyNAT(probe *natProbe) NATType {
+	if len(probe.mapped) == 0 {
+		return NATUnknown
+	}
+
+	byFamily := make(map[string][]string)
+	for _, addr := range probe.mapped {
+		family := addrFamily(addr)
+		byFamily[family] = append(byFamily[family], addr)
+	}
+
+	worst := NATNone
+	for family, mapped := range byFamily {
+		typ := n.classifyFamily(probe, family, mapped)
+		if natRestrictiveness(typ) > natRestrictiveness(worst) {
+			worst = typ
+		}
+	}
+	return worst
+}
+
+func (n *node) classifyFamily(probe *natProbe, family string, mapped []string) NATType {
+	for _, addr := range mapped[1:] {
+		if addr != mapped[0] {
+			return NATSymmetric
+		}
+	}
+
+	if n.isLocalAddr(mapped[0]) {
+		return NATNone
+	}
+	if probe.other[family] {
+		return NATFullCone
+	}
+	if probe.altPort[family] {
+		return NATRestricted
+	}
+	return NATPortRestricted
+}
+
+func natRestrictiveness(typ NATType) int {
+	for i, t := range []NATType{NATNone, NATFullCone, NATRestricted, NATPortRestricted, NATSymmetric} {
+		if t == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+func (n *node) isLocalAddr(addr string) bool {
+	addrs, err := n.interfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, local := range addrs {
+		if local == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// reflector r forwards signed request of p to c, c sends other probe to target from request
+func TestNATProbeFwdTarget(t *testing.T) {
+	c := newUDPNode(t, "c").(*node)
+	p := newUDPNode(t, "p").(*node)
+	r := newUDPNode(t, "r").(*node)
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	probed := func() bool {
+		buf := make([]byte, maxMTU)
+		target.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := target.ReadFrom(buf)
+		return err == nil
+	}
+
+	request := func(from *node, to string) *packet {
+		from.mu.Lock()
+		defer from.mu.Unlock()
+		return from.newPacket(to, &natProbeReqMsg{Nonce: "n", Other: true, Target: target.LocalAddr().String()})
+	}
+	forward := func(req *packet) error {
+		r.mu.Lock()
+		fwd := r.newPacket("c", &natProbeFwdMsg{Request: req})
+		r.mu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.processNATProbeFwd(fwd, "127.0.0.1:1")
+	}
+
+	// forwarder alone chooses target
+	err = forward(request(r, "r"))
+	if !errors.Is(err, ErrBadPayload) || probed() {
+		t.Fatalf("own request of forwarder: error %v", err)
+	}
+
+	// forwarder is not neighbor of requester
+	req := request(p, "r")
+	err = forward(req)
+	if err != nil || probed() {
+		t.Fatalf("request of p through stranger: error %v", err)
+	}
+
+	// tampered target
+	c.mu.Lock()
+	c.nodesNeighborState["p"] = neighborState{Neighbors: []string{"r"}}
+	c.mu.Unlock()
+	tampered := *req
+	tampered.Payload = []byte(`{"Nonce":"n","Other":true,"Target":"127.0.0.1:9"}`)
+	err = forward(&tampered)
+	if !errors.Is(err, ErrBadSignature) || probed() {
+		t.Fatalf("tampered request: error %v", err)
+	}
+
+	err = forward(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !probed() {
+		t.Fatal("target of valid request is not probed")
+	}
+	err = forward(req)
+	if err != nil || probed() {
+		t.Fatalf("same request again: error %v", err)
+	}
+}
@@ -1,58 +1,145 @@
 package node
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"net"
 	"sync"
 	"time"
 
 	"github.com/pavelverigo/natalie/internal/bimap"
+	"github.com/pavelverigo/natalie/internal/expset"
 	"github.com/pavelverigo/natalie/internal/set"
 )
 
 const directDestName = "DESTNAME_DIRECT_HANDSHAKE"
 const keepAliveInterval = 5 * time.Second
+const neighborSuspectTimeout = 2 * keepAliveInterval // removed after 3 intervals
 const routingStatusInterval = 10 * time.Second
-
-func New(name string, port int, log *log.Logger) (Node, error) {
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", port))
-	if err != nil {
-		return nil, err
-	}
-	conn, err := net.ListenUDP("udp4", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	return &node{
+const stateRefreshInterval = 30 * time.Second // origin reissues its state, even if nothing changed
+const stateMaxAge = 3 * stateRefreshInterval
+const defaultTTL = 16
+const seenCap = 4096
+const seenExpire = 2 * time.Minute          // how long delivered ids are remembered
+const relayedExpire = retransmitTimeout / 2 // shorter than retransmit, so relays pass retransmissions
+const maxClockSkew = 30 * time.Second
+const packetMaxAge = seenExpire - maxClockSkew // older packets could be already forgotten by seen, so replayed
+
+// New creates node listening on udp port, 0 picks free one, port is ignored if WithTransport is given
+func New(name string, port int, log *log.Logger, opts ...Option) (Node, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := &node{
 		log: log,
 		wg:  sync.WaitGroup{},
 		mu:  sync.Mutex{},
 
-		conn: conn,
-		port: conn.LocalAddr().(*net.UDPAddr).Port,
-		name: name,
+		ctx:    ctx,
+		cancel: cancel,
+
+		clock: realClock{},
+		name:  name,
 
 		name2addr: bimap.New[string, string](0),
 		knownAddr: set.New[string](0),
 
 		keepAliveTime: make(map[string]time.Time),
+		keepAliveWait: make(map[string]bool),
+		suspected:     make(map[string]bool),
+		rtt:           make(map[string]time.Duration),
+		linkCost:      make(map[string]uint64),
 
 		routingTable: map[string]string{
 			name: name,
 		},
-		nodesNeighborState: map[string]neighborState{
-			name: {
-				Seq:       0,
-				Neighbors: make([]string, 0),
-			},
-		},
+		routes:             make(map[string]RouteInfo),
+		nodesNeighborState: make(map[string]neighborState),
+		stateRecvTime:      make(map[string]time.Time),
+		purgedStates:       make(map[string]purgedState),
 
 		chatRecv: make([]ChatData, 0),
-	}, nil
+		chatSent: make([]ChatData, 0),
+
+		outgoing:       make(map[string]*outgoing),
+		deliveryStatus: make(map[string]DeliveryStatus),
+		deliveryDone:   make(map[string]time.Time),
+
+		seen:       expset.New[string](seenCap, seenExpire),
+		relayed:    expset.New[string](seenCap, relayedExpire),
+		probedReqs: expset.New[string](natProbedCap, packetMaxAge),
+
+		badPackets: make(map[string]*badPacketState),
+
+		handlers: make(map[string]handler),
+
+		defaultTTL: defaultTTL,
+
+		traversals:  make(map[string]*TraversalInfo),
+		virtual:     make(map[string]*virtualNeighbor),
+		relayAllocs: make(map[[2]string]*relayAllocation),
+		relayQuota:  defaultRelayQuota,
+
+		nat: NATInfo{Type: NATUnknown},
+
+		wireVersion: wireVersion,
+		wire:        make(map[string]uint8),
+
+		mtu:           defaultMTU,
+		linkMTU:       make(map[string]int),
+		fragments:     make(map[string]map[string]*reassembly),
+		fragmentBytes: make(map[string]int),
+
+		name2key: make(map[string]ed25519.PublicKey),
+		keyUsed:  make(map[string]time.Time),
+
+		sessions: make(map[string]*e2eSession),
+		e2eQueue: make(map[string]*e2eQueue),
+		kexSent:  make(map[string]time.Time),
+	}
+	n.registerBuiltinHandlers()
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	if n.transport == nil {
+		t, err := listenUDP(port)
+		if err != nil {
+			return nil, err
+		}
+		n.transport = t
+	}
+	n.port = transportPort(n.transport)
+
+	var err error
+	if n.priv == nil && n.identityPath != "" {
+		n.priv, err = loadIdentity(n.identityPath)
+	} else if n.priv == nil {
+		_, n.priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		n.transport.Close()
+		return nil, err
+	}
+	n.pub = n.priv.Public().(ed25519.PublicKey)
+
+	n.ownVersion = stateVersion{Epoch: newEpoch(n.clock.Now()), Seq: 0}
+	n.nodesNeighborState[name] = n.signState(neighborState{
+		Version:   n.ownVersion,
+		Neighbors: make([]string, 0),
+	})
+
+	n.ecdhPriv, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		n.transport.Close()
+		return nil, err
+	}
+
+	return n, nil
 }
 
 type node struct {
@@ -60,30 +147,128 @@ type node struct {
 	wg  sync.WaitGroup
 	mu  sync.Mutex
 
-	conn *net.UDPConn
-	port int
-	name string
+	ctx     context.Context // cancelled on Stop, all background loops exit
+	cancel  context.CancelFunc
+	started bool
+	stopped bool
+
+	transport Transport
+	clock     Clock
+	port      int // of transport address, used for host candidates and port mapping
+	name      string
 
 	name2addr *bimap.BiMap[string, string]
 	knownAddr *set.Set[string]
 
 	keepAliveTime map[string]time.Time // previosly recorded keep alive message from neighbor
+	keepAliveWait map[string]bool      // keep alive sent, reply not received yet
+	suspected     map[string]bool      // missed keep alive reply or failed retransmits, until next reply
+	rtt           map[string]time.Duration
+	linkCost      map[string]uint64 // advertised cost of link to neighbor
 
 	routingTable       map[string]string
+	routes             map[string]RouteInfo // by destination, routingTable with details
+	equalHops          map[string][]string  // next hops with same cost, by destination
+	ecmp               bool
 	nodesNeighborState map[string]neighborState
+	stateRecvTime      map[string]time.Time // when state of other node was received
+	purgedStates       map[string]purgedState
+	ownVersion         stateVersion
+	ownStateTime       time.Time
 
 	chatRecv []ChatData
+	chatSent []ChatData // pending status is filled from deliveryStatus on read
+
+	outgoing       map[string]*outgoing      // reliable packets waiting for ack, by id
+	deliveryStatus map[string]DeliveryStatus // by id of sent reliable packet
+	deliveryDone   map[string]time.Time      // when status became final, expired after deliveryStatusExpire
+
+	seen       *expset.ExpSet[string] // ids of delivered packets
+	relayed    *expset.ExpSet[string] // ids of recently relayed packets
+	probedReqs *expset.ExpSet[string] // ids of forwarded nat probe requests, we sent other probe for
+
+	badPackets   map[string]*badPacketState // by source addr
+	banThreshold int
+	banDuration  time.Duration
+
+	handlers map[string]handler // by packet type
+	deferred []func()           // user handler calls, run by read loop after unlock
+
+	defaultTTL uint8
+	stats      Stats
+
+	traversals  map[string]*TraversalInfo      // by peer name
+	virtual     map[string]*virtualNeighbor    // by peer name
+	relayAllocs map[[2]string]*relayAllocation // we relay for, by source and peer
+	relayQuota  uint64
+
+	nat          NATInfo
+	natProbe     *natProbe     // in progress
+	portSampling *portSampling // in progress
+	natSamples   []string      // mapped addresses of fresh bindings from last sampling, in send order
+
+	wireVersion uint8            // newest binary version we use, 0 sends only json
+	wire        map[string]uint8 // negotiated with neighbor, by name
+
+	mtu           int                               // largest datagram we send and accept
+	linkMTU       map[string]int                    // negotiated with neighbor, by name
+	fragments     map[string]map[string]*reassembly // by source, by group
+	fragmentBytes map[string]int                    // buffered by source
+
+	portMapEnabled bool
+	portMapGateway string // host:port, discovered if empty
+	portMap        PortMapInfo
+
+	priv         ed25519.PrivateKey
+	pub          ed25519.PublicKey
+	identityPath string
+	name2key     map[string]ed25519.PublicKey // name ownership, bound on first seen packet
+	keyUsed      map[string]time.Time         // last packet or state signed by bound key
+
+	ecdhPriv *ecdh.PrivateKey       // end to end encryption key, new on every start
+	sessions map[string]*e2eSession // by peer name
+	e2eQueue map[string]*e2eQueue   // packets waiting for key exchange, by destination
+	kexSent  map[string]time.Time
 }
 
 type neighborState struct {
-	Seq       uint
+	Version   stateVersion
 	Neighbors []string
+	Costs     []uint64 // link cost to each of neighbors, ms of rtt
+	Key       []byte   // public key of origin node
+	Sig       []byte   // signed by origin, so nobody else can advertise it
 }
 
 type ChatData struct {
-	Source string    `json:"src"`
-	Time   time.Time `json:"time"`
-	Text   string    `json:"text"`
+	Id     string         `json:"id,omitempty"`
+	Source string         `json:"src"`
+	Dest   string         `json:"dest"`
+	Time   time.Time      `json:"time"`
+	Text   string         `json:"text"`
+	Status DeliveryStatus `json:"status,omitempty"` // only for sent messages
+}
+
+type RouteInfo struct {
+	Dest    string    `json:"dest"`
+	NextHop string    `json:"next_hop"`
+	Backups []string  `json:"backups"` // loop free alternate hops, best first
+	Path    []string  `json:"path"`    // starts with us, ends with destination
+	Hops    int       `json:"hops"`
+	Cost    uint64    `json:"cost"`  // sum of link costs, ms of rtt
+	Epoch   uint64    `json:"epoch"` // of destination link-state, route was built from
+	Seq     uint64    `json:"seq"`
+	Changed time.Time `json:"changed"` // when next hop or path changed last time
+}
+
+type Stats struct {
+	TTLExpired         uint `json:"ttl_expired"` // dropped relayed packets
+	DuplicateDelivered uint `json:"duplicate_delivered"`
+	DuplicateRelayed   uint `json:"duplicate_relayed"`
+	StaleDropped       uint `json:"stale_dropped"` // delivered packets sent outside of seen window
+	RelayQuotaDropped  uint `json:"relay_quota_dropped"`
+	Fragmented         uint `json:"fragmented"` // packets sent in fragments
+	Reassembled        uint `json:"reassembled"`
+	ReassemblyDropped  uint `json:"reassembly_dropped"` // partial messages over limits or timed out
 }
 
 type Node interface {
@@ -94,30 +279,103 @@ type Node interface {
 	Neighbors() map[string]string
 	KnownAddr() []string
 	RoutingTable() map[string]string
+	Routes() map[string]RouteInfo
 	Chat() []ChatData
-
-	SendChat(dest, text string) error
+	SentChat() []ChatData
+	BadPackets() map[string]BadPacketStats
+	Stats() Stats
+	PublicKey() ed25519.PublicKey
+	PeerKeys() map[string]ed25519.PublicKey
+
+	// SendChat reliably sends text to dest, returns message id
+	SendChat(dest, text string, opts ...SendOption) (string, error)
+	// DeliveryStatus of reliable packet, final status is forgotten after some time
+	DeliveryStatus(id string) DeliveryStatus
+
+	// RegisterHandler adds custom packet type, which can be send with Send
+	RegisterHandler(typ string, h Handler) error
+	// Send msg encoded as JSON payload of packet type typ to dest
+	Send(dest string, typ string, msg any, opts ...SendOption) error
+	// SendReliable is like Send, but retransmits until dest acknowledges, returns message id
+	SendReliable(dest string, typ string, msg any, opts ...SendOption) (string, error)
 
 	DirectHandshake(addr string)
 	TraversalHandshake(name string, local bool)
+	Traverse(name string, opts TraversalOptions) error
+	Traversals() map[string]TraversalInfo
+
+	// DetectNAT asks neighbors how they see us, result is available with NAT after a while
+	DetectNAT() error
+	NAT() NATInfo
+	PortMapping() PortMapInfo
 }
 
+var errStopped = errors.New("node stopped")
+
 func (n *node) Start() error {
-	go n.readLoop()
-	go n.keepAliveLoop()
-	go n.routingLoop()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return errStopped
+	}
+	if n.started {
+		return errors.New("node already started")
+	}
+	n.started = true
+
+	n.spawn(n.readLoop)
+	n.spawn(n.keepAliveLoop)
+	n.spawn(n.routingLoop)
+	n.spawn(n.retransmitLoop)
+	n.spawn(n.traversalRetryLoop)
+	if n.portMapEnabled {
+		n.spawn(n.portMapLoop)
+	}
 
 	return nil
 }
 
+// Stop says goodbye to neighbors, stops all background loops and closes connection.
+// It waits for loops to exit, so it must not be called from Handler.Handle directly.
 func (n *node) Stop() error {
-	return nil
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return errStopped
+	}
+	n.stopped = true
+	n.sendGoodbye()
+	n.cancel()
+	n.mu.Unlock()
+
+	err := n.transport.Close()
+	n.wg.Wait()
+	return err
+}
+
+// spawn runs f in background goroutine tracked by wg, must be called with mu held
+func (n *node) spawn(f func()) {
+	if n.stopped {
+		return
+	}
+	n.wg.Add(1)
+	c, settling := n.clock.(SettlingClock)
+	if settling {
+		c.Busy(1)
+	}
+	go func() {
+		defer n.wg.Done()
+		if settling {
+			defer c.Busy(-1)
+		}
+		f()
+	}()
 }
 
 func (n *node) LocalAddr() string {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	return n.conn.LocalAddr().String()
+	return n.transport.LocalAddr()
 }
 
 func (n *node) Neighbors() map[string]string {
@@ -138,108 +396,268 @@ func (n *node) RoutingTable() map[string]string {
 	return copyMap(n.routingTable)
 }
 
+func (n *node) Routes() map[string]RouteInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r := make(map[string]RouteInfo, len(n.routes))
+	for dest, route := range n.routes {
+		route.Path = copySlice(route.Path)
+		route.Backups = copySlice(route.Backups)
+		r[dest] = route
+	}
+	return r
+}
+
 func (n *node) Chat() []ChatData {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	return copySlice(n.chatRecv)
 }
 
+func (n *node) BadPackets() map[string]BadPacketStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r := make(map[string]BadPacketStats, len(n.badPackets))
+	for addr, state := range n.badPackets {
+		r[addr] = state.BadPacketStats
+	}
+	return r
+}
+
+func (n *node) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+func (n *node) PublicKey() ed25519.PublicKey {
+	return n.pub
+}
+
+func (n *node) PeerKeys() map[string]ed25519.PublicKey {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return copyMap(n.name2key)
+}
+
 func (n *node) DirectHandshake(addr string) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	n.directHandshake(addr)
 }
 
-func (n *node) SendChat(dest, text string) error {
+func (n *node) SentChat() []ChatData {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r := copySlice(n.chatSent)
+	for i := range r {
+		if status, ok := n.deliveryStatus[r[i].Id]; ok {
+			r[i].Status = status
+		}
+	}
+	return r
+}
+
+func (n *node) SendChat(dest, text string, opts ...SendOption) (string, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	return n.sendChat(dest, text)
+	return n.sendChat(dest, text, opts...)
 }
 
 func (n *node) TraversalHandshake(name string, local bool) {
+	n.Traverse(name, TraversalOptions{Local: local})
+}
+
+func (n *node) Traverse(name string, opts TraversalOptions) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if opts.Predict == PredictNone || n.natProbe != nil || n.portSampling != nil {
+		return n.traversalHandshake(name, opts)
+	}
+	// nat type is known from detection, but ports are sampled with fresh bindings,
+	// right before peer starts spraying, so they are close to next allocated one
+	sample := func() {
+		err := n.samplePorts(func() {
+			n.traversalHandshake(name, opts)
+		})
+		if err != nil {
+			n.traversalHandshake(name, opts)
+		}
+	}
+	if n.nat.Checked.IsZero() {
+		return n.detectNAT(sample)
+	}
+	sample()
+	return nil
+}
+
+func (n *node) Traversals() map[string]TraversalInfo {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	n.traversalHandshake(name, local)
+	r := make(map[string]TraversalInfo, len(n.traversals))
+	for peer, t := range n.traversals {
+		r[peer] = *t
+	}
+	return r
 }
 
 func (n *node) removeNeighbor(name string) {
 	delete(n.keepAliveTime, name)
+	delete(n.keepAliveWait, name)
+	delete(n.suspected, name)
+	delete(n.rtt, name)
+	delete(n.linkCost, name)
+	delete(n.wire, name)
+	delete(n.linkMTU, name)
 	n.name2addr.DeleteByKey(name)
 	n.routingNeighborUpdate()
 }
 
 func (n *node) readLoop() {
-	buf := make([]byte, 8192)
+	buf := make([]byte, maxMTU) // larger messages arrive in fragments
 	for {
-		sz, netaddr, err := n.conn.ReadFrom(buf)
+		sz, addr, err := n.transport.ReadFrom(buf)
 		if err != nil {
-			log.Fatalln(err)
-		}
-		addr := netaddr.String()
-
-		pkt := &packet{}
-		err = json.Unmarshal(buf[:sz], pkt)
-		if err != nil {
-			log.Fatalln(err)
+			if n.ctx.Err() != nil {
+				return // closed by Stop
+			}
+			n.log.Println(err)
+			continue
 		}
 
 		n.mu.Lock()
 
-		neighbor, ok := n.name2addr.GetByValue(addr)
-		onlyLocal := (pkt.Type == "routingupdate" || pkt.Type == "keepalive" || pkt.Type == "routingstatus")
-		if !ok && onlyLocal {
-			n.log.Println("logic failed, local pkt", pkt)
+		if n.isBanned(addr) {
 			n.mu.Unlock()
 			continue
 		}
 
-		isHandshake := (pkt.Type == "handshakereq" || pkt.Type == "handshakeresp" || pkt.Type == "traversalreq" || pkt.Type == "traversalresp")
-		if ok && isHandshake && pkt.Destination == n.name && pkt.Destination == directDestName {
-			n.log.Println("handshake or traversal from neighbor", pkt)
-			n.mu.Unlock()
-			continue
+		err = n.handlePacket(buf[:sz], addr)
+		if err != nil {
+			if isBadPacket(err) {
+				n.recordBadPacket(addr, err)
+			}
+			n.log.Println(err)
+		}
+
+		deferred := n.deferred
+		n.deferred = nil
+
+		n.mu.Unlock()
+
+		for _, call := range deferred {
+			call()
+		}
+	}
+}
+
+// decode and process single datagram, must be called with mu held
+func (n *node) handlePacket(data []byte, addr string) error {
+	pkt, err := decodeWire(data)
+	if err != nil {
+		return &PacketError{Addr: addr, Err: err}
+	}
+
+	err = n.verifyPacket(pkt)
+	if err != nil {
+		return &PacketError{Addr: addr, Type: pkt.Type, Err: err}
+	}
+
+	h, known := n.handlers[pkt.Type]
+	forMe := pkt.Destination == n.name || pkt.Destination == directDestName
+
+	neighbor, ok := n.name2addr.GetByValue(addr)
+	if !ok && known && h.onlyLocal {
+		n.log.Println("logic failed, local pkt", pkt)
+		return nil
+	}
+
+	if ok && known && h.handshake && pkt.Destination == n.name && pkt.Destination == directDestName {
+		n.log.Println("handshake or traversal from neighbor", pkt)
+		return nil
+	}
+
+	if ok {
+		n.keepAliveTime[neighbor] = n.clock.Now() // update
+	}
+
+	if !forMe {
+		// relay does not need to know packet type
+		if pkt.TTL == 0 {
+			pkt.TTL = n.defaultTTL // from node without hop limit
+		}
+		if pkt.TTL <= 1 {
+			n.stats.TTLExpired++
+			return &PacketError{Addr: addr, Type: pkt.Type, Err: fmt.Errorf("%w: from %s to %s", ErrTTLExpired, pkt.Source, pkt.Destination)}
 		}
+		pkt.TTL--
 
-		if ok {
-			n.keepAliveTime[neighbor] = time.Now() // update
+		if pkt.Id != "" && !n.relayed.Add(pkt.Id, n.clock.Now()) {
+			n.stats.DuplicateRelayed++
+			return nil
 		}
 
-		if pkt.Destination != n.name && pkt.Destination != directDestName {
-			relayAddr := n.resolveRelayAddr(pkt.Destination)
-			if relayAddr == "" {
-				err = errors.New("unknown addr to relay to")
-			} else {
+		relayAddr := n.resolveRelayAddrFor(pkt.Destination, pkt.Id)
+		if relayAddr == "" {
+			err = errors.New("unknown addr to relay to")
+		} else {
+			err = n.chargeRelay(pkt.Source, pkt.Destination, len(data), n.clock.Now())
+			if err == nil {
 				err = n.sendPacket(relayAddr, pkt)
 			}
-		} else {
-			switch pkt.Type {
-			case "handshakereq":
-				err = n.processHandshakeReq(pkt, addr)
-			case "handshakeresp":
-				err = n.processHandshakeResp(pkt, addr)
-			case "keepalive":
-				err = n.processKeepAlive(pkt, addr)
-			case "routingstatus":
-				err = n.processRoutingStatus(pkt, addr)
-			case "routingupdate":
-				err = n.processRoutingUpdate(pkt, addr)
-			case "chat":
-				err = n.processChat(pkt, addr)
-			case "traversalreq":
-				err = n.processTraversalReq(pkt, addr)
-			case "traversalresp":
-				err = n.processTraversalResp(pkt, addr)
-			default:
-				err = errors.New(fmt.Sprint("unknown packet type:", pkt.Type))
-				log.Fatalln(err)
+		}
+	} else if known {
+		// neighbor and handshake packets are not time checked, so nodes with skewed clocks still connect
+		routable := !h.onlyLocal && !h.handshake
+		if err := checkPacketTime(pkt, n.clock.Now()); err != nil && routable {
+			n.stats.StaleDropped++
+			return &PacketError{Addr: addr, Type: pkt.Type, Err: err}
+		}
+		if pkt.Id != "" && n.seen.Contains(pkt.Id, n.clock.Now()) {
+			n.stats.DuplicateDelivered++
+			if pkt.Ack {
+				n.sendAck(pkt) // previous ack may be lost
 			}
+			return nil
 		}
-
-		if err != nil {
-			n.log.Println(err)
+		if pkt.Enc {
+			err = n.open(pkt)
+			if err != nil {
+				return &PacketError{Addr: addr, Type: pkt.Type, Err: err}
+			}
+		}
+		err = h.process(pkt, addr)
+		// rejected packet is not remembered, so its retransmission is not acked as duplicate
+		if err == nil && pkt.Id != "" && !h.unseen {
+			n.seen.Add(pkt.Id, n.clock.Now())
+		}
+		if err == nil && pkt.Ack {
+			n.sendAck(pkt)
 		}
+	} else {
+		err = ErrUnknownType
+	}
 
-		n.mu.Unlock()
+	if err != nil {
+		return &PacketError{Addr: addr, Type: pkt.Type, Err: err}
+	}
+	return nil
+}
+
+// packet is accepted only while its id is surely remembered by seen
+func checkPacketTime(pkt *packet, now time.Time) error {
+	sent := time.UnixMilli(pkt.Time)
+	if pkt.Time == 0 || now.Sub(sent) > packetMaxAge || sent.Sub(now) > maxClockSkew {
+		return fmt.Errorf("%w: sent at %s", ErrStalePacket, sent.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// routable packets of peer with skewed clock are dropped as stale, log it at handshake
+func (n *node) checkClockSkew(pkt *packet) {
+	skew := time.UnixMilli(pkt.Time).Sub(n.clock.Now())
+	if skew > maxClockSkew || -skew > maxClockSkew {
+		n.log.Printf("clock of %s differs from ours by %s, more than %s, its routable packets are dropped", pkt.Source, skew.Round(time.Second), maxClockSkew)
 	}
 }
 
@@ -248,17 +666,11 @@ type message interface {
 }
 
 func (n *node) newPacket(dest string, msg message) *packet {
-	payload, err := json.Marshal(msg)
+	pkt, err := n.encodePacket(dest, msg.Type(), msg)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	return &packet{
-		Id:          randomID(16),
-		Source:      n.name,
-		Destination: dest,
-		Type:        msg.Type(),
-		Payload:     payload,
-	}
+	return pkt
 }
 
 type packet struct {
@@ -267,19 +679,25 @@ type packet struct {
 	Destination string
 	Type        string
 	Payload     json.RawMessage
+	Ack         bool   // source waits for delivery ack
+	TTL         uint8  // decremented by every relay
+	Time        int64  // unix ms, when source created packet
+	Key         []byte // source public key
+	Sig         []byte // signature of all fields, except ttl
+	Enc         bool   // payload is encrypted for destination
+
+	plain json.RawMessage // not encrypted payload, kept by sender
 }
 
 func (n *node) sendPacket(addr string, pkt *packet) error {
-	netaddr, err := net.ResolveUDPAddr("udp4", addr)
+	data, err := encodeWire(pkt, n.wireFor(addr))
 	if err != nil {
 		return err
 	}
-
-	data, err := json.Marshal(pkt)
-	if err != nil {
-		log.Fatalln(err)
+	if mtu := n.mtuFor(addr); len(data) > mtu {
+		return n.sendFragments(addr, pkt, mtu)
 	}
 
-	_, err = n.conn.WriteTo(data, netaddr)
+	_, err = n.transport.WriteTo(data, addr)
 	return err
 }
@@ -0,0 +1,109 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+type Option func(*node)
+
+// WithBanPolicy temporarily bans address after threshold bad packets, disabled by default
+func WithBanPolicy(threshold int, duration time.Duration) Option {
+	return func(n *node) {
+		n.banThreshold = threshold
+		n.banDuration = duration
+	}
+}
+
+// WithDefaultTTL sets hop limit for packets, which send does not override with WithTTL,
+// 0 keeps package default
+func WithDefaultTTL(ttl uint8) Option {
+	return func(n *node) {
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		n.defaultTTL = ttl
+	}
+}
+
+// WithIdentity sets node key, by default new key is generated for every node,
+// so after restart peers accept the name only once its previous key is silent for a while
+func WithIdentity(priv ed25519.PrivateKey) Option {
+	return func(n *node) {
+		n.priv = priv
+	}
+}
+
+// WithIdentityFile loads node key from PEM file, file is created with new key if missing
+func WithIdentityFile(path string) Option {
+	return func(n *node) {
+		n.identityPath = path
+	}
+}
+
+// WithECMP spreads packets over next hops with equal path cost
+func WithECMP() Option {
+	return func(n *node) {
+		n.ecmp = true
+	}
+}
+
+// WithRelayQuota limits traffic relayed for each virtual neighbor allocation, 0 disables allocations
+func WithRelayQuota(bytesPerMinute uint64) Option {
+	return func(n *node) {
+		n.relayQuota = bytesPerMinute
+	}
+}
+
+// WithPortMapping asks gateway for external mapping of node port with PCP or NAT-PMP,
+// empty gateway address is discovered from default route
+func WithPortMapping(gateway string) Option {
+	return func(n *node) {
+		n.portMapEnabled = true
+		n.portMapGateway = gateway
+	}
+}
+
+// WithTransport replaces udp socket, for example with in memory network
+func WithTransport(t Transport) Option {
+	return func(n *node) {
+		n.transport = t
+	}
+}
+
+// WithClock replaces system clock of timers and timestamps
+func WithClock(c Clock) Option {
+	return func(n *node) {
+		n.clock = c
+	}
+}
+
+// WithJSONWire sends all packets as json, for debugging, binary packets are still accepted
+func WithJSONWire() Option {
+	return func(n *node) {
+		n.wireVersion = 0
+	}
+}
+
+// WithMTU sets largest datagram node sends and accepts, larger packets are fragmented,
+// link uses smaller mtu of its two ends
+func WithMTU(mtu int) Option {
+	return func(n *node) {
+		if mtu < minMTU {
+			mtu = minMTU
+		}
+		if mtu > maxMTU {
+			mtu = maxMTU
+		}
+		n.mtu = mtu
+	}
+}
+
+type SendOption func(*packet)
+
+// WithTTL limits number of relays packet may pass, 0 means node default ttl
+func WithTTL(ttl uint8) SendOption {
+	return func(pkt *packet) {
+		pkt.TTL = ttl
+	}
+}
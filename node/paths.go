@@ -0,0 +1,167 @@
+package node
+
+import (
+	"time"
+)
+
+const defaultLinkCost = 100         // ms, until rtt is measured
+const costHysteresis = 25           // percent, smaller rtt changes are not advertised
+const routeHysteresis = 10          // percent, current route is kept, unless new one is that much better
+const rttSmoothing = 8              // weight of previous rtt, against new sample
+const unreachable = ^uint64(0) >> 1 // large enough, but summing two does not overflow
+
+// weighted links built from nodes neighbor state, cost is in ms of rtt
+type linkGraph map[string]map[string]uint64
+
+// smoothed rtt from keep alive round trips, cost is advertised only on significant change
+func (n *node) updateRTT(name string, sample time.Duration) {
+	if _, ok := n.name2addr.GetByKey(name); !ok {
+		return
+	}
+
+	rtt, ok := n.rtt[name]
+	if ok {
+		rtt = (rtt*(rttSmoothing-1) + sample) / rttSmoothing
+	} else {
+		rtt = sample
+	}
+	n.rtt[name] = rtt
+
+	cost := uint64(rtt.Milliseconds())
+	if cost < 1 {
+		cost = 1
+	}
+	prev, ok := n.linkCost[name]
+	if ok {
+		diff := cost - prev
+		if prev > cost {
+			diff = prev - cost
+		}
+		if diff < 2 || diff*100 <= prev*costHysteresis {
+			return
+		}
+	}
+	n.linkCost[name] = cost
+	n.routingNeighborUpdate()
+}
+
+func (n *node) ownCost(name string) uint64 {
+	cost, ok := n.linkCost[name]
+	if !ok {
+		return defaultLinkCost
+	}
+	return cost
+}
+
+// percent of v, without overflow of v*p
+func percentOf(v uint64, p uint64) uint64 {
+	return v/100*p + v%100*p/100
+}
+
+// a is at most p percent worse than b
+func withinPercent(a uint64, b uint64, p uint64) bool {
+	return a <= b || a-b <= percentOf(b, p)
+}
+
+func (n *node) buildGraph() linkGraph {
+	g := make(linkGraph, len(n.nodesNeighborState))
+
+	// advertised costs are clamped, so path through all nodes is still below unreachable
+	maxCost := unreachable / uint64(len(n.nodesNeighborState)+1)
+
+	// own links are known from neighbors directly
+	own := make(map[string]uint64, n.name2addr.Len())
+	for _, name := range n.name2addr.Keys() {
+		own[name] = n.ownCost(name)
+		if own[name] > maxCost {
+			own[name] = maxCost
+		}
+	}
+	g[n.name] = own
+
+	for from, state := range n.nodesNeighborState {
+		if from == n.name {
+			continue
+		}
+		links := make(map[string]uint64, len(state.Neighbors))
+		for i, to := range state.Neighbors {
+			if to == n.name {
+				if _, ok := own[from]; !ok {
+					continue // stale, we are not neighbors anymore
+				}
+			} else if !n.listsNeighbor(to, from) {
+				continue
+			}
+			cost := uint64(defaultLinkCost)
+			if i < len(state.Costs) && state.Costs[i] > 0 {
+				cost = state.Costs[i]
+			}
+			if cost > maxCost {
+				cost = maxCost
+			}
+			links[to] = cost
+		}
+		g[from] = links
+	}
+
+	return g
+}
+
+// dijkstra from src, graph is small, so simple quadratic version is enough,
+// exclude node is not used, to find paths which do not loop through it
+func (g linkGraph) shortestPaths(src string, exclude string) (map[string]uint64, map[string]string) {
+	dist := map[string]uint64{src: 0}
+	prev := make(map[string]string)
+	done := make(map[string]bool)
+
+	for {
+		cur := ""
+		best := unreachable
+		for name, d := range dist {
+			if !done[name] && d < best {
+				cur, best = name, d
+			}
+		}
+		if cur == "" {
+			break
+		}
+		done[cur] = true
+
+		for to, cost := range g[cur] {
+			if to == exclude || done[to] {
+				continue
+			}
+			d, ok := dist[to]
+			if !ok || best+cost < d {
+				dist[to] = best + cost
+				prev[to] = cur
+			}
+		}
+	}
+
+	return dist, prev
+}
+
+func firstHop(prev map[string]string, src string, dest string) string {
+	if dest == src {
+		return src
+	}
+	hop := dest
+	for prev[hop] != src {
+		hop = prev[hop]
+	}
+	return hop
+}
+
+// path from src to dest including both ends
+func pathTo(prev map[string]string, src string, dest string) []string {
+	path := []string{dest}
+	for hop := dest; hop != src; {
+		hop = prev[hop]
+		path = append(path, hop)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
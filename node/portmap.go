@@ -0,0 +1,104 @@
+package node
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackpal/gateway"
+	"github.com/pavelverigo/natalie/internal/portmap"
+)
+
+const (
+	portMapLifetime      = time.Hour
+	portMapRetryInterval = time.Minute
+	portUnmapTimeout     = 500 * time.Millisecond // so stop is not delayed by silent gateway
+)
+
+type PortMapInfo struct {
+	Protocol string    `json:"protocol,omitempty"`
+	Gateway  string    `json:"gateway,omitempty"`
+	External string    `json:"external,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (n *node) PortMapping() PortMapInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.portMap
+}
+
+// mapped external address, if mapping is still valid
+func (n *node) mappedAddr(now time.Time) (string, bool) {
+	if n.portMap.External == "" || now.After(n.portMap.Expires) {
+		return "", false
+	}
+	return n.portMap.External, true
+}
+
+// keeps mapping of our port on gateway, renewed at half of lifetime, removed on stop
+func (n *node) portMapLoop() {
+	gw := n.portMapGateway
+	var m *portmap.Mapping
+	for {
+		var err error
+		if gw == "" {
+			gw, err = discoverGateway()
+		}
+		var next *portmap.Mapping
+		if err == nil {
+			if m == nil {
+				next, err = portmap.Map(n.ctx, gw, n.port, portMapLifetime)
+			} else {
+				next, err = portmap.Renew(n.ctx, m, portMapLifetime)
+			}
+		}
+
+		n.mu.Lock()
+		now := n.clock.Now()
+		wait := portMapRetryInterval
+		if err != nil {
+			n.log.Println("port mapping:", err)
+			n.portMap.Error = err.Error()
+			if _, ok := n.mappedAddr(now); !ok {
+				m = nil // expired, ask for new one next time
+			}
+		} else {
+			m = next
+			n.portMap = PortMapInfo{
+				Protocol: string(m.Protocol),
+				Gateway:  gw,
+				External: m.External.String(),
+				Expires:  now.Add(m.Lifetime),
+			}
+			wait = m.Lifetime / 2
+			if wait < time.Second {
+				wait = time.Second
+			}
+		}
+		n.mu.Unlock()
+
+		if !n.sleep(wait) {
+			break
+		}
+	}
+
+	if m != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), portUnmapTimeout)
+		defer cancel()
+		err := portmap.Unmap(ctx, m)
+		if err != nil {
+			n.log.Println("port unmapping:", err)
+		}
+	}
+}
+
+func discoverGateway() (string, error) {
+	ip, err := gateway.DiscoverGateway()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(portmap.DefaultPort)), nil
+}
@@ -0,0 +1,319 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const maxPredictRange = 512
+const defaultPredictRange = 64
+const maxSprayRate = 1000 // handshakes per second
+const defaultSprayRate = 100
+const portSamples = 3 // fresh nat bindings made just before spraying
+const portSampleTimeout = time.Second
+
+type PortPrediction string
+
+const (
+	PredictNone   PortPrediction = ""       // only known addresses
+	PredictLinear PortPrediction = "linear" // follow sampled allocation step
+	PredictRange  PortPrediction = "range"  // ports around last sampled one, for random allocation
+)
+
+type TraversalOptions struct {
+	Local   bool // advertise local interface address too
+	Predict PortPrediction
+	Range   int // ports to spray, capped by maxPredictRange
+	Rate    int // handshakes per second, capped by maxSprayRate
+
+	Coordinated bool // both sides start at time agreed over relay, with fast bursts
+}
+
+func (opts TraversalOptions) limits() (int, int) {
+	r := opts.Range
+	if r <= 0 {
+		r = defaultPredictRange
+	}
+	if r > maxPredictRange {
+		r = maxPredictRange
+	}
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = defaultSprayRate
+	}
+	if rate > maxSprayRate {
+		rate = maxSprayRate
+	}
+	return r, rate
+}
+
+// port allocation pattern of our symmetric nat, advertised to traversal peer
+type portPrediction struct {
+	IP    string
+	Base  int // last sampled port
+	Delta int // allocation step, 0 if looks random
+}
+
+// samples are mapped addresses in order of allocation
+func predictPorts(samples []string) *portPrediction {
+	if len(samples) == 0 {
+		return nil
+	}
+	ports := make([]int, 0, len(samples))
+	ip := ""
+	for _, addr := range samples {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		if ip != "" && host != ip {
+			return nil // several public ips, unable to predict
+		}
+		ip = host
+		ports = append(ports, port)
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	// smallest positive step, if all steps are small and positive
+	delta := 0
+	for i := 1; i < len(ports); i++ {
+		d := ports[i] - ports[i-1]
+		if d <= 0 || d > 16 {
+			delta = 0
+			break
+		}
+		if delta == 0 || d < delta {
+			delta = d
+		}
+	}
+
+	return &portPrediction{
+		IP:    ip,
+		Base:  ports[len(ports)-1],
+		Delta: delta,
+	}
+}
+
+// addresses to spray handshakes to, nearest to base first
+func (p *portPrediction) targets(strategy PortPrediction, r int) []string {
+	if p == nil || strategy == PredictNone {
+		return nil
+	}
+	if strategy == PredictLinear && p.Delta == 0 {
+		strategy = PredictRange
+	}
+
+	ports := make([]int, 0, r)
+	switch strategy {
+	case PredictLinear:
+		for k := 1; len(ports) < r; k++ {
+			port := p.Base + p.Delta*k
+			if port > 65535 {
+				break
+			}
+			ports = append(ports, port)
+		}
+	case PredictRange:
+		for k := 1; len(ports) < r && k <= r; k++ {
+			if port := p.Base + k; port <= 65535 {
+				ports = append(ports, port)
+			}
+			if port := p.Base - k; port > 0 && len(ports) < r {
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	targets := make([]string, len(ports))
+	for i, port := range ports {
+		targets[i] = net.JoinHostPort(p.IP, strconv.Itoa(port))
+	}
+	return targets
+}
+
+// own prediction, if last nat detection found symmetric nat
+func (n *node) ownPrediction() *portPrediction {
+	if n.nat.Type != NATSymmetric {
+		return nil
+	}
+	return predictPorts(n.natSamples)
+}
+
+// sampling in progress, every sample is sent to port reflector never used before,
+// so nat allocates new binding for it
+type portSampling struct {
+	order  []string          // nonces in order samples were sent
+	mapped map[string]string // our address seen by fresh port, by nonce
+	asked  map[string]string // reflector asked to open fresh port, by nonce
+}
+
+type natSampleReqMsg struct {
+	Nonce string
+}
+
+func (msg *natSampleReqMsg) Type() string {
+	return "natsamplereq"
+}
+
+type natSamplePortMsg struct {
+	Nonce string
+	Port  int // fresh port on reflector ip
+}
+
+func (msg *natSamplePortMsg) Type() string {
+	return "natsampleport"
+}
+
+type natSampleMsg struct {
+	Nonce string
+}
+
+func (msg *natSampleMsg) Type() string {
+	return "natsample"
+}
+
+// open fresh port and report our address seen on it over neighbor link
+func (n *node) processNATSampleReq(pkt *packet, addr string) error {
+	msg := &natSampleReqMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	alt, ok := n.transport.(AltPortTransport)
+	if !ok {
+		return errNoAltPort
+	}
+	t, err := alt.ListenAltPort()
+	if err != nil {
+		return err
+	}
+	_, portStr, err := net.SplitHostPort(t.LocalAddr())
+	if err != nil {
+		t.Close()
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	n.spawn(func() {
+		n.sleep(portSampleTimeout)
+		t.Close()
+	})
+	n.spawn(func() {
+		n.serveSample(t, pkt.Source, msg.Nonce)
+	})
+
+	return n.sendPacket(addr, n.newPacket(pkt.Source, &natSamplePortMsg{
+		Nonce: msg.Nonce,
+		Port:  port,
+	}))
+}
+
+// wait for single sample from requester on fresh port, until it is closed
+func (n *node) serveSample(t Transport, requester string, nonce string) {
+	buf := make([]byte, maxMTU)
+	for {
+		sz, from, err := t.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pkt, err := decodeWire(buf[:sz])
+		if err != nil || pkt.Type != "natsample" || pkt.Source != requester {
+			continue
+		}
+		msg := &natSampleMsg{}
+		if json.Unmarshal(pkt.Payload, msg) != nil || msg.Nonce != nonce {
+			continue
+		}
+
+		n.mu.Lock()
+		addr, ok := n.name2addr.GetByKey(requester)
+		if ok && n.verifyPacket(pkt) == nil {
+			n.sendPacket(addr, n.newPacket(requester, &natProbeRespMsg{
+				Nonce: nonce,
+				Addr:  from,
+			}))
+		}
+		n.mu.Unlock()
+		t.Close()
+		return
+	}
+}
+
+// send sample to fresh port as soon as reflector opens it
+func (n *node) processNATSamplePort(pkt *packet, addr string) error {
+	msg := &natSamplePortMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	s := n.portSampling
+	if s == nil || s.asked[msg.Nonce] != pkt.Source {
+		return nil // late
+	}
+	delete(s.asked, msg.Nonce)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	s.order = append(s.order, msg.Nonce)
+	return n.sendPacket(net.JoinHostPort(host, strconv.Itoa(msg.Port)), n.newPacket(pkt.Source, &natSampleMsg{
+		Nonce: msg.Nonce,
+	}))
+}
+
+// sample port allocation with fresh bindings, then done is called with lock held
+func (n *node) samplePorts(done func()) error {
+	if n.portSampling != nil {
+		return errors.New("port sampling in progress")
+	}
+	reflectors := n.name2addr.Keys()
+	if len(reflectors) == 0 {
+		return errors.New("no neighbors to use as reflectors")
+	}
+	sort.Strings(reflectors)
+
+	s := &portSampling{
+		mapped: make(map[string]string),
+		asked:  make(map[string]string),
+	}
+	n.portSampling = s
+	for i := 0; i < portSamples; i++ {
+		name := reflectors[i%len(reflectors)]
+		nonce := randomID(8)
+		s.asked[nonce] = name
+		addr, _ := n.name2addr.GetByKey(name)
+		n.sendPacket(addr, n.newPacket(name, &natSampleReqMsg{
+			Nonce: nonce,
+		}))
+	}
+
+	n.spawn(func() {
+		if !n.sleep(portSampleTimeout) {
+			return
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.natSamples = make([]string, 0, len(s.order))
+		for _, nonce := range s.order {
+			if addr, ok := s.mapped[nonce]; ok {
+				n.natSamples = append(n.natSamples, addr)
+			}
+		}
+		n.portSampling = nil
+		done()
+	})
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	punchMargin      = 50 * time.Millisecond // extra delay, so sync surely arrives before start
+	punchSyncTimeout = 2 * time.Second       // responder punches uncoordinated, if sync was lost
+)
+
+// pacing of connectivity checks and pauses between rounds
+type punchSchedule struct {
+	check  time.Duration
+	rounds []time.Duration
+}
+
+var defaultSchedule = punchSchedule{
+	check:  checkInterval,
+	rounds: []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second},
+}
+
+// both sides punch at once, so fast bursts open bindings before short nat timeouts
+var burstSchedule = punchSchedule{
+	check:  5 * time.Millisecond,
+	rounds: []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond},
+}
+
+// checks prepared on traversal message, started at agreed time
+type pendingPunch struct {
+	checks []Candidate
+	spray  []string
+	rate   int
+}
+
+// delay is relative to arrival, so clocks of peers do not need to be in sync
+type traversalSyncMsg struct {
+	Delay time.Duration
+}
+
+func (msg *traversalSyncMsg) Type() string {
+	return "traversalsync"
+}
+
+var errSyncDelay = errors.New("sync delay out of range")
+
+func (n *node) processTraversalSync(pkt *packet, addr string) error {
+	msg := &traversalSyncMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+	if msg.Delay < 0 || msg.Delay > punchSyncTimeout {
+		return badPayload(errSyncDelay)
+	}
+
+	n.startPunch(pkt.Source, msg.Delay)
+	return nil
+}
+
+// initiator got response, relay rtt is known, so propose start
+func (n *node) syncPunch(peer string, t *TraversalInfo) error {
+	rtt := n.clock.Now().Sub(t.reqSent)
+	t.RelayRTT = rtt
+
+	relayAddr := n.resolveRelayAddr(peer)
+	if relayAddr == "" {
+		return errUnknown
+	}
+	err := n.sendPacket(relayAddr, n.newPacket(peer, &traversalSyncMsg{
+		Delay: punchMargin,
+	}))
+	if err != nil {
+		return err
+	}
+	// sync reaches peer in about half rtt
+	n.startPunch(peer, rtt/2+punchMargin)
+	return nil
+}
+
+// responder starts anyway, if sync did not come in time
+func (n *node) punchSyncTimeout(peer string) {
+	if !n.sleep(punchSyncTimeout) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t, ok := n.traversals[peer]; ok && t.punch != nil {
+		n.log.Println("traversal sync from", peer, "timed out, punching uncoordinated")
+		n.startPunch(peer, 0)
+	}
+}
+
+func (n *node) startPunch(peer string, delay time.Duration) {
+	t, ok := n.traversals[peer]
+	if !ok || t.punch == nil {
+		return
+	}
+	p := t.punch
+	t.punch = nil
+	n.spawn(func() {
+		if !n.sleep(delay) {
+			return
+		}
+		n.traversalLoop(peer, burstSchedule, p.checks, p.spray, p.rate)
+	})
+}
@@ -0,0 +1,180 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const relayAllocLifetime = 10 * time.Minute
+const relayQuotaWindow = time.Minute
+const defaultRelayQuota = 1 << 20 // bytes per window, for each allocation
+
+var ErrRelayQuota = errors.New("relay quota exceeded")
+
+// peer reachable through pinned relay, when direct traversal failed
+type virtualNeighbor struct {
+	relay   string
+	expires time.Time
+}
+
+// allocation on relay side, for traffic from neighbor to peer
+type relayAllocation struct {
+	used        uint64
+	windowStart time.Time
+	expires     time.Time
+}
+
+type relayAllocReqMsg struct {
+	Peer string
+}
+
+func (msg *relayAllocReqMsg) Type() string {
+	return "relayallocreq"
+}
+
+type relayAllocRespMsg struct {
+	Peer     string
+	Granted  bool
+	Quota    uint64 // bytes per minute
+	Lifetime time.Duration
+}
+
+func (msg *relayAllocRespMsg) Type() string {
+	return "relayallocresp"
+}
+
+type relayFreeMsg struct {
+	Peer string
+}
+
+func (msg *relayFreeMsg) Type() string {
+	return "relayfree"
+}
+
+func (n *node) processRelayAllocReq(pkt *packet, addr string) error {
+	msg := &relayAllocReqMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	_, neighbor := n.name2addr.GetByKey(msg.Peer)
+	granted := neighbor && n.relayQuota > 0 && msg.Peer != pkt.Source
+	if granted {
+		key := [2]string{pkt.Source, msg.Peer}
+		alloc, ok := n.relayAllocs[key]
+		if !ok {
+			alloc = &relayAllocation{windowStart: n.clock.Now()}
+			n.relayAllocs[key] = alloc
+		}
+		alloc.expires = n.clock.Now().Add(relayAllocLifetime)
+	}
+
+	return n.sendPacket(addr, n.newPacket(pkt.Source, &relayAllocRespMsg{
+		Peer:     msg.Peer,
+		Granted:  granted,
+		Quota:    n.relayQuota,
+		Lifetime: relayAllocLifetime,
+	}))
+}
+
+func (n *node) processRelayAllocResp(pkt *packet, addr string) error {
+	msg := &relayAllocRespMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	t, ok := n.traversals[msg.Peer]
+	if !ok || t.State == TraversalDirect {
+		return nil
+	}
+	if !msg.Granted {
+		t.State = TraversalFailed
+		t.Updated = n.clock.Now()
+		delete(n.virtual, msg.Peer)
+		return nil
+	}
+
+	n.virtual[msg.Peer] = &virtualNeighbor{
+		relay:   pkt.Source,
+		expires: n.clock.Now().Add(msg.Lifetime),
+	}
+	t.State = TraversalRelayed
+	t.Relay = pkt.Source
+	t.Updated = n.clock.Now()
+	n.nominateRelayPair(msg.Peer, pkt.Source)
+
+	return nil
+}
+
+func (n *node) processRelayFree(pkt *packet, addr string) error {
+	msg := &relayFreeMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	delete(n.relayAllocs, [2]string{pkt.Source, msg.Peer})
+
+	return nil
+}
+
+// ask neighbor on current route to peer to relay our traffic
+func (n *node) requestRelay(peer string) error {
+	relay, ok := n.routingTable[peer]
+	if !ok || relay == peer || relay == n.name {
+		return errUnknown
+	}
+	addr, _ := n.name2addr.GetByKey(relay)
+	return n.sendPacket(addr, n.newPacket(relay, &relayAllocReqMsg{
+		Peer: peer,
+	}))
+}
+
+func (n *node) releaseRelay(peer string) {
+	v, ok := n.virtual[peer]
+	if !ok {
+		return
+	}
+	delete(n.virtual, peer)
+
+	addr, ok := n.name2addr.GetByKey(v.relay)
+	if ok {
+		n.sendPacket(addr, n.newPacket(v.relay, &relayFreeMsg{
+			Peer: peer,
+		}))
+	}
+}
+
+// relay for virtual neighbor, if allocation is still valid
+func (n *node) virtualRelay(dest string, now time.Time) (string, bool) {
+	v, ok := n.virtual[dest]
+	if !ok || now.After(v.expires) || !n.neighborAlive(v.relay, now) {
+		return "", false
+	}
+	return v.relay, true
+}
+
+// account relayed traffic of allocation, traffic without allocation is not limited
+func (n *node) chargeRelay(src string, dest string, size int, now time.Time) error {
+	alloc, ok := n.relayAllocs[[2]string{src, dest}]
+	if !ok {
+		return nil
+	}
+	if now.After(alloc.expires) {
+		delete(n.relayAllocs, [2]string{src, dest})
+		return nil
+	}
+	if now.Sub(alloc.windowStart) > relayQuotaWindow {
+		alloc.windowStart = now
+		alloc.used = 0
+	}
+	alloc.used += uint64(size)
+	if alloc.used > n.relayQuota {
+		n.stats.RelayQuotaDropped++
+		return ErrRelayQuota
+	}
+	return nil
+}
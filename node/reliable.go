@@ -0,0 +1,172 @@
+package node
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const retransmitTimeout = time.Second // first retransmit, doubled on every attempt
+const retransmitAttempts = 5
+const retransmitTick = 250 * time.Millisecond
+const deliveryStatusExpire = 10 * time.Minute // how long final status is kept
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+type outgoing struct {
+	pkt      *packet
+	attempts int
+	timeout  time.Duration
+	next     time.Time
+	hop      string // neighbor of last attempt, suspected if attempt is not acked
+}
+
+type ackMsg struct {
+	Id string
+}
+
+func (msg *ackMsg) Type() string {
+	return "ack"
+}
+
+func (n *node) processAck(pkt *packet, addr string) error {
+	msg := &ackMsg{}
+	err := json.Unmarshal(pkt.Payload, msg)
+	if err != nil {
+		return badPayload(err)
+	}
+
+	out, ok := n.outgoing[msg.Id]
+	if !ok || out.pkt.Source != n.name || out.pkt.Destination != pkt.Source {
+		return nil // late ack or already delivered
+	}
+	delete(n.outgoing, msg.Id)
+	n.finishDelivery(msg.Id, DeliveryDelivered)
+
+	return nil
+}
+
+func (n *node) SendReliable(dest string, typ string, msg any, opts ...SendOption) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sendReliable(dest, typ, msg, opts...)
+}
+
+func (n *node) DeliveryStatus(id string) DeliveryStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deliveryStatus[id]
+}
+
+// send packet, which is retransmitted until dest acknowledges it, returns packet id
+func (n *node) sendReliable(dest string, typ string, msg any, opts ...SendOption) (string, error) {
+	addr := n.resolveRelayAddr(dest)
+	if addr == "" {
+		return "", errUnknown
+	}
+	opts = append(opts, func(pkt *packet) { pkt.Ack = true })
+	pkt, err := n.encodePacket(dest, typ, msg, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	out := &outgoing{
+		pkt:      pkt,
+		attempts: 1,
+		timeout:  retransmitTimeout,
+		next:     n.clock.Now().Add(retransmitTimeout),
+	}
+	n.outgoing[pkt.Id] = out
+	n.deliveryStatus[pkt.Id] = DeliveryPending
+
+	err = n.sendSealed(pkt)
+	if pkt.Enc {
+		out.hop, _ = n.name2addr.GetByValue(n.resolveRelayAddrFor(dest, pkt.Id))
+	}
+	return pkt.Id, err
+}
+
+func (n *node) sendAck(pkt *packet) {
+	addr := n.resolveRelayAddr(pkt.Source)
+	if addr == "" {
+		n.log.Println("unable to ack, unknown route to", pkt.Source)
+		return
+	}
+	n.sendPacket(addr, n.newPacket(pkt.Source, &ackMsg{
+		Id: pkt.Id,
+	}))
+}
+
+// record final status, chat keeps its own copy since status expires
+func (n *node) finishDelivery(id string, status DeliveryStatus) {
+	n.deliveryStatus[id] = status
+	n.deliveryDone[id] = n.clock.Now()
+	for i := len(n.chatSent) - 1; i >= 0; i-- {
+		if n.chatSent[i].Id == id {
+			n.chatSent[i].Status = status
+			break
+		}
+	}
+}
+
+func (n *node) expireDeliveryStatus(now time.Time) {
+	for id, done := range n.deliveryDone {
+		if now.Sub(done) > deliveryStatusExpire {
+			delete(n.deliveryStatus, id)
+			delete(n.deliveryDone, id)
+		}
+	}
+}
+
+func (n *node) retransmitLoop() {
+	for {
+		if !n.sleep(retransmitTick) {
+			return
+		}
+
+		n.mu.Lock()
+
+		now := n.clock.Now()
+		n.expireDeliveryStatus(now)
+		n.purgeFragments(now) // also of senders, which stopped mid message
+		for id, out := range n.outgoing {
+			if now.Before(out.next) {
+				continue
+			}
+			if out.attempts >= retransmitAttempts {
+				delete(n.outgoing, id)
+				n.finishDelivery(id, DeliveryFailed)
+				continue
+			}
+
+			out.attempts++
+			out.timeout *= 2
+			out.next = now.Add(out.timeout)
+
+			if !out.pkt.Enc {
+				n.requestKex(out.pkt.Destination) // still waiting in e2e queue
+				continue
+			}
+
+			if out.hop != "" {
+				n.suspectNeighbor(out.hop)
+			}
+
+			// route may be changed since previous attempt
+			addr := n.resolveRelayAddrFor(out.pkt.Destination, out.pkt.Id)
+			out.hop, _ = n.name2addr.GetByValue(addr)
+			if addr != "" {
+				n.sendPacket(addr, out.pkt)
+			}
+		}
+
+		n.checkE2EQueues(now)
+
+		n.mu.Unlock()
+	}
+}
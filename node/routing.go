@@ -2,12 +2,53 @@ package node
 
 import (
 	"encoding/json"
-	"log"
+	"hash/fnv"
+	"math"
+	"sort"
 	"time"
 )
 
+// version of node neighbor state, epoch is new on every node start,
+// so restarted node is accepted at once, despite lower seq
+type stateVersion struct {
+	Epoch uint64
+	Seq   uint64
+}
+
+func (v stateVersion) newer(o stateVersion) bool {
+	return v.Epoch > o.Epoch || (v.Epoch == o.Epoch && v.Seq > o.Seq)
+}
+
+// seq wraps around into next epoch, so version always grows
+func (v stateVersion) next() stateVersion {
+	if v.Seq == math.MaxUint64 {
+		return stateVersion{Epoch: v.Epoch + 1, Seq: 0}
+	}
+	return stateVersion{Epoch: v.Epoch, Seq: v.Seq + 1}
+}
+
+// tombstone of purged state, protects from reaccepting same state from neighbors
+type purgedState struct {
+	Version stateVersion
+	Time    time.Time
+}
+
+// version of state we know, including purged ones
+func (n *node) knownVersion(name string) (stateVersion, bool) {
+	state, ok := n.nodesNeighborState[name]
+	if ok {
+		return state.Version, true
+	}
+	purged, ok := n.purgedStates[name]
+	return purged.Version, ok
+}
+
+func newEpoch(now time.Time) uint64 {
+	return uint64(now.UnixNano())
+}
+
 type routingStatusMsg struct {
-	SeqState map[string]uint
+	SeqState map[string]stateVersion
 }
 
 func (msg *routingStatusMsg) Type() string {
@@ -18,7 +59,7 @@ func (n *node) processRoutingStatus(pkt *packet, addr string) error {
 	msg := &routingStatusMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	// log.Println(n.name, "status", msg.SeqState)
@@ -27,14 +68,15 @@ func (n *node) processRoutingStatus(pkt *packet, addr string) error {
 
 	nodes := make(map[string]neighborState) // which should be send after
 	newState := false
-	for name, seq := range msg.SeqState {
-		state, ok := n.nodesNeighborState[name]
-		if !ok || state.Seq < seq {
+	for name, version := range msg.SeqState {
+		known, ok := n.knownVersion(name)
+		if !ok || version.newer(known) {
 			newState = true
 			continue
 		}
-		if state.Seq > seq {
-			nodes[name] = n.nodesNeighborState[name]
+		state, ok := n.nodesNeighborState[name]
+		if ok && state.Version.newer(version) {
+			nodes[name] = state
 		}
 	}
 	for name, state := range n.nodesNeighborState {
@@ -71,18 +113,42 @@ func (n *node) processRoutingUpdate(pkt *packet, addr string) error {
 	msg := &routingUpdateMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	// log.Println(n.name, "update", msg.Nodes)
 
 	recvNew := false
+	var rejected error
 	for name, state1 := range msg.Nodes {
-		state2, ok := n.nodesNeighborState[name]
-		if !ok || state2.Seq < state1.Seq {
-			n.nodesNeighborState[name] = state1
-			recvNew = true
+		known, ok := n.knownVersion(name)
+		if ok && !state1.Version.newer(known) {
+			continue
+		}
+		if name == n.name {
+			// only we are source of truth for our state, but network remembers
+			// our previous run with greater version (clock went back), so move past it
+			if n.verifyState(name, state1) == nil {
+				n.ownVersion = stateVersion{Epoch: state1.Version.Epoch + 1, Seq: 0}
+				n.routingNeighborUpdate()
+			}
+			continue
 		}
+		err := n.verifyState(name, state1)
+		if err != nil {
+			// do not store or flood, but accept other states, neighbor is blamed
+			// only for its own state, forwarded ones may be from restarted nodes
+			if name == pkt.Source {
+				rejected = err
+			} else {
+				n.log.Println("rejected state forwarded by", pkt.Source, err)
+			}
+			continue
+		}
+		n.nodesNeighborState[name] = state1
+		n.stateRecvTime[name] = n.clock.Now()
+		delete(n.purgedStates, name)
+		recvNew = true
 	}
 
 	if recvNew {
@@ -90,53 +156,178 @@ func (n *node) processRoutingUpdate(pkt *packet, addr string) error {
 		n.broadcastRoutingStatusExcept(pkt.Source) // TODO: handle error
 	}
 
-	return nil
+	return rejected
 }
 
-// BFS, calculate routing table from nodes neighbor state
+// calculate routing table from nodes neighbor state, with shortest paths by link cost
 func (n *node) recalculateRoutingTable() {
-	layer := n.name2addr.Keys()
-	bfs := make(map[string]string)
-	// init state
-	bfs[n.name] = n.name
-	for _, name := range layer {
-		bfs[name] = name
-	}
-
-	for len(layer) > 0 {
-		newLayer := make([]string, 0)
-		for _, from := range layer {
-			state, ok := n.nodesNeighborState[from]
-			if !ok {
-				continue
-			}
-			for _, to := range state.Neighbors {
-				_, ok := bfs[to]
+	g := n.buildGraph()
+	dist, prev := g.shortestPaths(n.name, "")
+
+	type viaPaths struct {
+		dist map[string]uint64
+		prev map[string]string
+	}
+	via := make(map[string]viaPaths) // from neighbor, not passing us
+
+	// full paths from every neighbor, for loop free alternates
+	neighborPaths := make(map[string]map[string]uint64, len(g[n.name]))
+	for neighbor := range g[n.name] {
+		neighborPaths[neighbor], _ = g.shortestPaths(neighbor, "")
+	}
+
+	now := n.clock.Now()
+	table := make(map[string]string, len(dist))
+	equalHops := make(map[string][]string)
+	routes := make(map[string]RouteInfo, len(dist))
+	for dest, cost := range dist {
+		hop := firstHop(prev, n.name, dest)
+		path := pathTo(prev, n.name, dest)
+
+		// keep previous hop, if it is still good enough, so routes do not flap,
+		// and its own shortest path does not come back through us
+		old, ok := n.routingTable[dest]
+		if ok && old != hop && old != n.name {
+			full, okFull := neighborPaths[old][dest]
+			back, okBack := neighborPaths[old][n.name]
+			if linkCost, ok := g[n.name][old]; ok && okFull && okBack && full < back+dist[dest] {
+				v, ok := via[old]
 				if !ok {
-					newLayer = append(newLayer, to)
-					bfs[to] = bfs[from]
+					v.dist, v.prev = g.shortestPaths(old, n.name)
+					via[old] = v
+				}
+				if oldDist, ok := v.dist[dest]; ok && withinPercent(linkCost+oldDist, cost, routeHysteresis) {
+					hop = old
+					cost = linkCost + oldDist
+					path = append([]string{n.name}, pathTo(v.prev, old, dest)...)
 				}
 			}
 		}
-		layer = newLayer
+
+		backups, equal := n.alternateHops(g, neighborPaths, dist, dest, hop, cost)
+
+		route := RouteInfo{
+			Dest:    dest,
+			NextHop: hop,
+			Backups: backups,
+			Path:    path,
+			Hops:    len(path) - 1,
+			Cost:    cost,
+			Epoch:   n.nodesNeighborState[dest].Version.Epoch,
+			Seq:     n.nodesNeighborState[dest].Version.Seq,
+			Changed: now,
+		}
+		prevRoute, ok := n.routes[dest]
+		if ok && prevRoute.NextHop == hop && equalSlices(prevRoute.Path, path) {
+			route.Changed = prevRoute.Changed
+		}
+
+		table[dest] = hop
+		routes[dest] = route
+		if len(equal) > 0 {
+			equalHops[dest] = append([]string{hop}, equal...)
+		}
 	}
 
-	n.routingTable = bfs
+	n.routingTable = table
+	n.routes = routes
+	n.equalHops = equalHops
+}
+
+// loop free alternates for dest, sorted by cost, and those of them with same cost as primary hop
+func (n *node) alternateHops(g linkGraph, neighborPaths map[string]map[string]uint64, dist map[string]uint64, dest string, primary string, cost uint64) ([]string, []string) {
+	type alternate struct {
+		hop  string
+		cost uint64
+	}
+	alternates := make([]alternate, 0)
+	for neighbor, linkCost := range g[n.name] {
+		if neighbor == primary || dest == n.name {
+			continue
+		}
+		d, ok := neighborPaths[neighbor][dest]
+		back, okBack := neighborPaths[neighbor][n.name]
+		// neighbor shortest path to dest does not go back through us
+		if !ok || !okBack || d >= back+dist[dest] {
+			continue
+		}
+		alternates = append(alternates, alternate{hop: neighbor, cost: linkCost + d})
+	}
+	sort.Slice(alternates, func(i, j int) bool {
+		if alternates[i].cost != alternates[j].cost {
+			return alternates[i].cost < alternates[j].cost
+		}
+		return alternates[i].hop < alternates[j].hop
+	})
+
+	backups := make([]string, len(alternates))
+	equal := make([]string, 0)
+	for i, alt := range alternates {
+		backups[i] = alt.hop
+		if alt.cost == cost {
+			equal = append(equal, alt.hop)
+		}
+	}
+	return backups, equal
+}
+
+// edge is valid only if both ends list each other, stale state of one side is ignored
+func (n *node) listsNeighbor(name string, neighbor string) bool {
+	state, ok := n.nodesNeighborState[name]
+	if !ok {
+		return false
+	}
+	for _, other := range state.Neighbors {
+		if other == neighbor {
+			return true
+		}
+	}
+	return false
 }
 
 func (n *node) resolveRelayAddr(dest string) string {
+	return n.resolveRelayAddrFor(dest, "")
+}
+
+// resolve relay for packet with id, if primary hop is suspected to be dead
+// first alive backup is used, without waiting for routing to converge
+func (n *node) resolveRelayAddrFor(dest string, id string) string {
 	relay, ok := n.routingTable[dest]
 	if !ok {
 		return ""
 	}
+
+	now := n.clock.Now()
+	if relay != dest {
+		if virtual, ok := n.virtualRelay(dest, now); ok {
+			relay = virtual
+		}
+	}
+
+	equal := n.equalHops[dest]
+	if n.ecmp && id != "" && len(equal) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		relay = equal[h.Sum32()%uint32(len(equal))]
+	}
+
+	if relay != n.name && !n.neighborAlive(relay, now) {
+		for _, backup := range n.routes[dest].Backups {
+			if n.neighborAlive(backup, now) {
+				relay = backup
+				break
+			}
+		}
+	}
+
 	addr, _ := n.name2addr.GetByKey(relay)
 	return addr
 }
 
 func (n *node) sendRoutingStatus(dest string) error {
-	seqState := make(map[string]uint, len(n.nodesNeighborState))
+	seqState := make(map[string]stateVersion, len(n.nodesNeighborState))
 	for name, state := range n.nodesNeighborState {
-		seqState[name] = state.Seq
+		seqState[name] = state.Version
 	}
 
 	addr, _ := n.name2addr.GetByKey(dest)
@@ -159,11 +350,18 @@ func (n *node) broadcastRoutingStatusExcept(ignore string) error {
 // neighbor was deleted or added,
 // note: calculated state may not be reconstructed from neighborstate, until new neighbor send his state
 func (n *node) routingNeighborUpdate() error {
-	prev := n.nodesNeighborState[n.name]
-	n.nodesNeighborState[n.name] = neighborState{
-		Seq:       prev.Seq + 1,
-		Neighbors: n.name2addr.Keys(),
+	n.ownVersion = n.ownVersion.next()
+	neighbors := n.name2addr.Keys()
+	costs := make([]uint64, len(neighbors))
+	for i, name := range neighbors {
+		costs[i] = n.ownCost(name)
 	}
+	n.nodesNeighborState[n.name] = n.signState(neighborState{
+		Version:   n.ownVersion,
+		Neighbors: neighbors,
+		Costs:     costs,
+	})
+	n.ownStateTime = n.clock.Now()
 
 	n.recalculateRoutingTable()
 
@@ -172,12 +370,47 @@ func (n *node) routingNeighborUpdate() error {
 
 func (n *node) routingLoop() { // may help when packets lost, or reordered (handshake response recieved, after routing distance msg)
 	for {
-		time.Sleep(routingStatusInterval)
+		if !n.sleep(routingStatusInterval) {
+			return
+		}
 
 		n.mu.Lock()
 
-		n.broadcastRoutingStatusExcept("") // send to everyone
+		now := n.clock.Now()
+		n.purgeExpiredStates(now)
+		if now.Sub(n.ownStateTime) >= stateRefreshInterval {
+			n.routingNeighborUpdate() // refresh, so others do not age us out
+		} else {
+			n.broadcastRoutingStatusExcept("") // send to everyone
+		}
 
 		n.mu.Unlock()
 	}
 }
+
+// drop states of nodes, which origin did not refresh for too long
+func (n *node) purgeExpiredStates(now time.Time) {
+	purged := false
+	for name, t := range n.stateRecvTime {
+		if now.Sub(t) <= stateMaxAge {
+			continue
+		}
+		n.purgedStates[name] = purgedState{
+			Version: n.nodesNeighborState[name].Version,
+			Time:    now,
+		}
+		delete(n.nodesNeighborState, name)
+		delete(n.stateRecvTime, name)
+		purged = true
+	}
+
+	for name, tomb := range n.purgedStates {
+		if now.Sub(tomb.Time) > 2*stateMaxAge {
+			delete(n.purgedStates, name)
+		}
+	}
+
+	if purged {
+		n.recalculateRoutingTable()
+	}
+}
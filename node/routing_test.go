@@ -0,0 +1,40 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestForwardedStateRejectionNotBlamed(t *testing.T) {
+	n := newUDPNode(t, "a").(*node)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	signed := func(priv ed25519.PrivateKey, seq uint64) neighborState {
+		state := neighborState{Version: stateVersion{Epoch: 1, Seq: seq}, Key: priv.Public().(ed25519.PublicKey)}
+		state.Sig = ed25519.Sign(priv, stateSignData("c", state))
+		return state
+	}
+	update := func(source string, state neighborState) error {
+		pkt := n.newPacket(n.name, &routingUpdateMsg{Nodes: map[string]neighborState{"c": state}})
+		pkt.Source = source
+		return n.processRoutingUpdate(pkt, "10.0.0.2:1000")
+	}
+	_, old, _ := ed25519.GenerateKey(nil)
+	_, restarted, _ := ed25519.GenerateKey(nil)
+
+	err := update("b", signed(old, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c restarted with new key, while old one is still bound
+	err = update("b", signed(restarted, 2))
+	if err != nil {
+		t.Fatal("forwarding neighbor is blamed:", err)
+	}
+	err = update("c", signed(restarted, 3))
+	if !errors.Is(err, ErrNameConflict) {
+		t.Fatalf("error %v, want name conflict", err)
+	}
+}
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"net"
+	"strconv"
+)
+
+// Transport is packet connection node sends and receives through,
+// addresses are host:port strings, as used in neighbor and candidate addresses
+type Transport interface {
+	ReadFrom(p []byte) (n int, addr string, err error) // blocks until packet, returns error after Close
+	WriteTo(p []byte, addr string) (n int, err error)
+	LocalAddr() string
+	Close() error
+}
+
+// AltPortTransport is optionally implemented by transport, which can open temporary
+// socket on same host, nat detection uses it to find if nat filters by port
+type AltPortTransport interface {
+	ListenAltPort() (Transport, error)
+}
+
+// InterfaceTransport is optionally implemented by transport, which may be reached
+// on several local addresses, otherwise only LocalAddr is used as host candidate
+type InterfaceTransport interface {
+	InterfaceAddrs() ([]string, error)
+}
+
+// udp socket, dual stack if system supports it
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func listenUDP(port int) (*udpTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+func (t *udpTransport) ReadFrom(p []byte) (int, string, error) {
+	n, addr, err := t.conn.ReadFrom(p)
+	if err != nil {
+		return n, "", err
+	}
+	return n, addr.String(), nil
+}
+
+func (t *udpTransport) WriteTo(p []byte, addr string) (int, error) {
+	netaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	return t.conn.WriteTo(p, netaddr)
+}
+
+func (t *udpTransport) LocalAddr() string {
+	return t.conn.LocalAddr().String()
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *udpTransport) ListenAltPort() (Transport, error) {
+	return listenUDP(0)
+}
+
+// addresses of all interfaces with our port, including loopback
+func (t *udpTransport) InterfaceAddrs() ([]string, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(t.conn.LocalAddr().(*net.UDPAddr).Port)
+	addrs := make([]string, 0, len(ifaceAddrs))
+	for _, ifaceAddr := range ifaceAddrs {
+		ipnet, ok := ifaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ipnet.IP.String(), port))
+	}
+	return addrs, nil
+}
+
+// port of transport address, 0 if it has none
+func transportPort(t Transport) int {
+	_, portStr, err := net.SplitHostPort(t.LocalAddr())
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return port
+}
+
+// local addresses we may be reached on
+func (n *node) interfaceAddrs() ([]string, error) {
+	if t, ok := n.transport.(InterfaceTransport); ok {
+		return t.InterfaceAddrs()
+	}
+	return []string{n.transport.LocalAddr()}, nil
+}
@@ -2,16 +2,55 @@ package node
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"time"
+)
+
+const (
+	traversalRetryInterval = time.Minute           // failed or relayed traversal is retried to upgrade to direct path
+	checkInterval          = 20 * time.Millisecond // pacing of connectivity checks
+)
 
-	"github.com/jackpal/gateway"
+type TraversalState string
+
+const (
+	TraversalPending TraversalState = "pending"
+	TraversalDirect  TraversalState = "direct"
+	TraversalRelayed TraversalState = "relayed" // direct failed, virtual neighbor through relay
+	TraversalFailed  TraversalState = "failed"
 )
 
+type TraversalInfo struct {
+	Peer      string         `json:"peer"`
+	State     TraversalState `json:"state"`
+	Relay     string         `json:"relay,omitempty"`
+	Initiator bool           `json:"initiator"`
+	Local     bool           `json:"local"`
+	Predict   PortPrediction `json:"predict,omitempty"`
+	Attempts  int            `json:"attempts"`
+	Pair      *CandidatePair `json:"pair,omitempty"`     // nominated pair, first successful check
+	RelayRTT  time.Duration  `json:"relayRtt,omitempty"` // of traversal messages, when coordinated
+	Started   time.Time      `json:"started"`
+	Updated   time.Time      `json:"updated"`
+
+	LocalCandidates  []Candidate `json:"localCandidates"`
+	RemoteCandidates []Candidate `json:"remoteCandidates"`
+
+	opts    TraversalOptions // to retry with
+	reqSent time.Time
+	punch   *pendingPunch // waits for sync, when coordinated
+}
+
 type traversalReqMsg struct {
-	KnownAddr []string
-	UseLocal  bool
+	KnownAddr  []string // for nodes without candidates support
+	Candidates []Candidate
+	UseLocal   bool
+	Predict    *portPrediction // our ports, if we are behind symmetric nat
+	Strategy   PortPrediction
+	Range      int
+	Rate       int
+
+	Coordinated bool // responder waits for sync before punching
 }
 
 func (msg *traversalReqMsg) Type() string {
@@ -19,8 +58,10 @@ func (msg *traversalReqMsg) Type() string {
 }
 
 type traversalRespMsg struct {
-	KnownAddr []string
-	UseLocal  bool
+	KnownAddr  []string
+	Candidates []Candidate
+	UseLocal   bool
+	Predict    *portPrediction
 }
 
 func (msg *traversalRespMsg) Type() string {
@@ -31,7 +72,7 @@ func (n *node) processTraversalReq(pkt *packet, addr string) error {
 	msg := &traversalReqMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	if pkt.Source == n.name {
@@ -39,11 +80,37 @@ func (n *node) processTraversalReq(pkt *packet, addr string) error {
 		return nil
 	}
 
-	go n.traversalLoop(pkt.Source, msg.KnownAddr)
+	opts := TraversalOptions{
+		Local:   msg.UseLocal,
+		Predict: msg.Strategy,
+		Range:   msg.Range,
+		Rate:    msg.Rate,
 
+		Coordinated: msg.Coordinated,
+	}
+	t := n.startTraversal(pkt.Source, false, opts)
+	t.LocalCandidates = n.gatherCandidates(pkt.Source, msg.UseLocal)
+	t.RemoteCandidates = remoteCandidates(msg.Candidates, msg.KnownAddr)
+	r, rate := opts.limits()
+	src := pkt.Source
+	checks := checkOrder(t.LocalCandidates, t.RemoteCandidates, false)
+	spray := msg.Predict.targets(opts.Predict, r)
+	if opts.Coordinated {
+		t.punch = &pendingPunch{checks: checks, spray: spray, rate: rate}
+		n.spawn(func() { n.punchSyncTimeout(src) })
+	} else {
+		n.spawn(func() { n.traversalLoop(src, defaultSchedule, checks, spray, rate) })
+	}
+
+	var predict *portPrediction
+	if opts.Predict != PredictNone {
+		predict = n.ownPrediction()
+	}
 	respPkt := n.newPacket(pkt.Source, &traversalRespMsg{
-		KnownAddr: n.getPossibleAddresses(msg.UseLocal),
-		UseLocal:  msg.UseLocal,
+		KnownAddr:  candidateAddrs(t.LocalCandidates),
+		Candidates: t.LocalCandidates,
+		UseLocal:   msg.UseLocal,
+		Predict:    predict,
 	})
 	relayAddr := n.resolveRelayAddr(pkt.Source)
 	if relayAddr == "" {
@@ -57,7 +124,7 @@ func (n *node) processTraversalResp(pkt *packet, addr string) error {
 	msg := &traversalRespMsg{}
 	err := json.Unmarshal(pkt.Payload, msg)
 	if err != nil {
-		log.Fatalln(err)
+		return badPayload(err)
 	}
 
 	if pkt.Source == n.name {
@@ -65,56 +132,266 @@ func (n *node) processTraversalResp(pkt *packet, addr string) error {
 		return nil
 	}
 
-	go n.traversalLoop(pkt.Source, msg.KnownAddr)
+	t, ok := n.traversals[pkt.Source]
+	if !ok {
+		return nil // traversal was not requested by us
+	}
+	t.RemoteCandidates = remoteCandidates(msg.Candidates, msg.KnownAddr)
+	if t.Pair != nil && t.Pair.Remote.Type == CandidatePeer {
+		// check of peer arrived before its candidates
+		t.Pair.Remote = findCandidate(t.RemoteCandidates, t.Pair.Remote.Addr)
+	}
+	r, rate := t.opts.limits()
+	src := pkt.Source
+	checks := checkOrder(t.LocalCandidates, t.RemoteCandidates, true)
+	spray := msg.Predict.targets(t.opts.Predict, r)
+	if t.opts.Coordinated {
+		t.punch = &pendingPunch{checks: checks, spray: spray, rate: rate}
+		return n.syncPunch(src, t)
+	}
+	n.spawn(func() { n.traversalLoop(src, defaultSchedule, checks, spray, rate) })
 
 	return nil
 }
 
-func (n *node) traversalLoop(dest string, known []string) {
-	i := 0
-	for i < 3 {
+// connectivity checks in pair priority order, then predicted ports of symmetric nat sprayed with limited rate
+func (n *node) traversalLoop(dest string, schedule punchSchedule, checks []Candidate, spray []string, rate int) {
+	for _, pause := range schedule.rounds {
 		n.mu.Lock()
 		_, ok := n.name2addr.GetByKey(dest)
 		if ok {
 			log.Println("already traversed, finish")
+			n.traversalDone(dest)
 			n.mu.Unlock()
 			return
 		}
+		n.mu.Unlock()
+
+		if !n.checkCandidates(dest, checks, schedule.check) {
+			return
+		}
+
+		if !n.sprayHandshakes(dest, spray, rate) {
+			return
+		}
+
+		if !n.sleep(pause) {
+			return
+		}
+	}
 
-		for _, addr := range known {
-			pkt := n.newPacket(dest, &handshakeReqMsg{
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.name2addr.GetByKey(dest); ok {
+		n.traversalDone(dest)
+		return
+	}
+	n.traversalFailed(dest)
+}
+
+// send handshake to every remote candidate, paced so better pairs succeed first,
+// returns false if node was stopped
+func (n *node) checkCandidates(dest string, checks []Candidate, interval time.Duration) bool {
+	for _, c := range checks {
+		n.mu.Lock()
+		if _, ok := n.name2addr.GetByKey(dest); ok {
+			n.mu.Unlock()
+			return true
+		}
+		n.sendPacket(c.Addr, n.newPacket(dest, &handshakeReqMsg{
+			ServerAddr: c.Addr,
+			Wire:       n.wireVersion,
+			MTU:        n.mtu,
+		}))
+		n.mu.Unlock()
+
+		if !n.sleep(interval) {
+			return false
+		}
+	}
+	return true
+}
+
+// send handshakes in small batches, returns false if node was stopped
+func (n *node) sprayHandshakes(dest string, targets []string, rate int) bool {
+	const batchInterval = 100 * time.Millisecond
+	batch := rate / int(time.Second/batchInterval)
+	if batch < 1 {
+		batch = 1
+	}
+
+	for len(targets) > 0 {
+		n.mu.Lock()
+		if _, ok := n.name2addr.GetByKey(dest); ok {
+			n.mu.Unlock()
+			return true
+		}
+		for i := 0; i < batch && len(targets) > 0; i++ {
+			addr := targets[0]
+			targets = targets[1:]
+			n.sendPacket(addr, n.newPacket(dest, &handshakeReqMsg{
 				ServerAddr: addr,
-			})
-			n.sendPacket(addr, pkt)
+				Wire:       n.wireVersion,
+				MTU:        n.mtu,
+			}))
 		}
 		n.mu.Unlock()
 
-		time.Sleep(time.Second * 2)
-		i++
+		if !n.sleep(batchInterval) {
+			return false
+		}
 	}
+	return true
 }
 
-func (n *node) getPossibleAddresses(local bool) []string {
-	r := n.knownAddr.Keys()
-	if local {
-		ip, err := gateway.DiscoverInterface()
-		if err != nil {
-			log.Fatalln(err, "getPossible")
+func (n *node) startTraversal(peer string, initiator bool, opts TraversalOptions) *TraversalInfo {
+	now := n.clock.Now()
+	t, ok := n.traversals[peer]
+	if !ok {
+		t = &TraversalInfo{
+			Peer:    peer,
+			State:   TraversalPending,
+			Started: now,
 		}
-		r = append(r, fmt.Sprintf("%s:%d", ip, n.port))
+		n.traversals[peer] = t
 	}
-	return r
+	t.Initiator = t.Initiator || initiator
+	t.Local = opts.Local
+	t.Predict = opts.Predict
+	t.opts = opts
+	t.Attempts++
+	t.Updated = now
+	if t.State == TraversalFailed || t.State == TraversalDirect {
+		t.State = TraversalPending
+	}
+	return t
 }
 
-func (n *node) traversalHandshake(dest string, local bool) error {
+// remember pair of first successful check, local is our address as seen by peer
+func (n *node) nominatePair(peer string, local string, remote string) {
+	t, ok := n.traversals[peer]
+	if !ok {
+		return
+	}
+	// late ipv6 check still upgrades direct pair, same as neighbor address
+	upgrade := t.Pair != nil && isIPv6(remote) && !isIPv6(t.Pair.Remote.Addr)
+	if t.State == TraversalDirect && !upgrade {
+		return
+	}
+	t.Pair = &CandidatePair{
+		Local:  findCandidate(t.LocalCandidates, local),
+		Remote: findCandidate(t.RemoteCandidates, remote),
+	}
+}
+
+// relay candidates of both sides form pair, when falling back to virtual neighbor
+func (n *node) nominateRelayPair(peer string, relay string) {
+	t, ok := n.traversals[peer]
+	if !ok {
+		return
+	}
+	pair := &CandidatePair{
+		Local:  Candidate{Type: CandidateRelay, Relay: relay, Priority: candidatePriority(CandidateRelay, 65535)},
+		Remote: Candidate{Type: CandidateRelay, Relay: relay, Priority: candidatePriority(CandidateRelay, 65535)},
+	}
+	for _, c := range t.RemoteCandidates {
+		if c.Type == CandidateRelay {
+			pair.Remote = c
+		}
+	}
+	t.Pair = pair
+}
+
+// direct link established, relay is not needed anymore
+func (n *node) traversalDone(peer string) {
+	t, ok := n.traversals[peer]
+	if !ok || t.State == TraversalDirect {
+		return
+	}
+	t.State = TraversalDirect
+	t.Relay = ""
+	t.Updated = n.clock.Now()
+	n.releaseRelay(peer)
+}
+
+// fallback to virtual neighbor through relay, keep existing relay if any
+func (n *node) traversalFailed(peer string) {
+	t, ok := n.traversals[peer]
+	if !ok || t.State == TraversalDirect {
+		return
+	}
+	t.Updated = n.clock.Now()
+	if _, ok := n.virtual[peer]; ok {
+		t.State = TraversalRelayed
+		return
+	}
+	t.State = TraversalFailed
+	err := n.requestRelay(peer)
+	if err != nil {
+		n.log.Println("relay fallback to", peer, "failed:", err)
+	}
+}
+
+// retry traversal in background, so relayed peers are upgraded to direct path
+func (n *node) traversalRetryLoop() {
+	for {
+		if !n.sleep(traversalRetryInterval) {
+			return
+		}
+
+		n.mu.Lock()
+
+		now := n.clock.Now()
+		for peer, t := range n.traversals {
+			if t.State != TraversalRelayed && t.State != TraversalFailed {
+				continue
+			}
+			if v, ok := n.virtual[peer]; ok && v.expires.Sub(now) < relayAllocLifetime/2 {
+				n.requestRelay(peer) // refresh allocation
+			}
+			if t.Initiator {
+				n.traversalHandshake(peer, t.opts)
+			}
+		}
+
+		for key, alloc := range n.relayAllocs {
+			if now.After(alloc.expires) {
+				delete(n.relayAllocs, key)
+			}
+		}
+
+		n.mu.Unlock()
+	}
+}
+
+func (n *node) traversalHandshake(dest string, opts TraversalOptions) error {
+	if _, ok := n.name2addr.GetByKey(dest); ok {
+		return nil // already neighbors
+	}
+	t := n.startTraversal(dest, true, opts)
+	t.LocalCandidates = n.gatherCandidates(dest, opts.Local)
+
+	var predict *portPrediction
+	if opts.Predict != PredictNone {
+		predict = n.ownPrediction()
+	}
 	pkt := n.newPacket(dest, &traversalReqMsg{
-		KnownAddr: n.getPossibleAddresses(local),
-		UseLocal:  local,
+		KnownAddr:  candidateAddrs(t.LocalCandidates),
+		Candidates: t.LocalCandidates,
+		UseLocal:   opts.Local,
+		Predict:    predict,
+		Strategy:   opts.Predict,
+		Range:      opts.Range,
+		Rate:       opts.Rate,
+
+		Coordinated: opts.Coordinated,
 	})
 	relayAddr := n.resolveRelayAddr(dest)
 	if relayAddr == "" {
 		log.Println("traversal req unable to contact who requested")
+		n.traversals[dest].State = TraversalFailed
 		return nil
 	}
+	t.reqSent = n.clock.Now()
 	return n.sendPacket(relayAddr, pkt)
 }
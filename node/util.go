@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"log"
+	"net"
+	"time"
 )
 
 func randomID(size int) string {
@@ -23,8 +25,60 @@ func copyMap[K comparable, V any](m map[K]V) map[K]V {
 	return r
 }
 
+func contains[T comparable](s []T, v T) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func equalSlices[T comparable](a []T, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func copySlice[T any](s []T) []T {
 	r := make([]T, len(s))
 	copy(r, s)
 	return r
 }
+
+// sleep for d, returns false if node was stopped meanwhile
+func (n *node) sleep(d time.Duration) bool {
+	if c, ok := n.clock.(SettlingClock); ok {
+		return c.Sleep(n.ctx, d)
+	}
+	select {
+	case <-n.clock.After(d):
+		return true
+	case <-n.ctx.Done():
+		return false
+	}
+}
+
+// ipv4 addresses in dual stack socket are reported as plain ipv4
+// "ip4" or "ip6", addresses of different families are never compared
+func addrFamily(addr string) string {
+	if isIPv6(addr) {
+		return "ip6"
+	}
+	return "ip4"
+}
+
+func isIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,220 @@
+package node
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// binary framing of packet, negotiated in handshake, json is used with
+// not yet negotiated addresses and nodes without binary support:
+//
+//	magic (2) | version (1) | flags (1) | type code (1) | ttl (1) | time (varint) |
+//	id | source | destination | [type name, if code is 0] | payload | key | sig
+//
+// where variable fields are prefixed with uvarint length
+const wireVersion = 1 // newest version we encode, older ones must stay decodable
+
+var wireMagic = [2]byte{0xa7, 0x4e}
+
+const (
+	wireFlagAck    = 1 << iota
+	wireFlagEnc    // payload is encrypted
+	wireFlagRawID  // id sent as bytes, it is base64 string in packet
+	wireFlagRawEnc // encrypted payload sent as bytes, it is json base64 string in packet
+)
+
+const wireHeaderSize = 6
+
+// codes of builtin types, append only, custom types are sent by name with code 0
+var wireTypes = []string{
+	"",
+	"handshakereq", "handshakeresp", "traversalreq", "traversalresp", "traversalsync",
+	"keepalive", "goodbye", "routingstatus", "routingupdate",
+	"relayallocreq", "relayallocresp", "relayfree",
+	"natprobereq", "natproberesp", "natprobefwd", "natprobe",
+	"ack", "kexreq", "kexresp", "chat",
+	"fragment",
+	"natsamplereq", "natsampleport", "natsample",
+}
+
+var wireTypeCodes = func() map[string]byte {
+	codes := make(map[string]byte, len(wireTypes))
+	for i, typ := range wireTypes[1:] {
+		codes[typ] = byte(i + 1)
+	}
+	return codes
+}()
+
+var ErrWireVersion = errors.New("unsupported wire format version")
+
+// wire version used with neighbor at addr, 0 is json
+func (n *node) wireFor(addr string) uint8 {
+	name, ok := n.name2addr.GetByValue(addr)
+	if !ok {
+		return 0
+	}
+	return n.wire[name]
+}
+
+// remember version both sides support, peer sends newest version it supports
+func (n *node) negotiateWire(name string, version uint8) {
+	if version > n.wireVersion {
+		version = n.wireVersion
+	}
+	n.wire[name] = version
+}
+
+func encodeWire(pkt *packet, version uint8) ([]byte, error) {
+	if version == 0 {
+		return json.Marshal(pkt)
+	}
+
+	var flags byte
+	if pkt.Ack {
+		flags |= wireFlagAck
+	}
+	if pkt.Enc {
+		flags |= wireFlagEnc
+	}
+	id := []byte(pkt.Id)
+	if raw, ok := rawBase64(pkt.Id, base64.RawStdEncoding); ok {
+		id = raw
+		flags |= wireFlagRawID
+	}
+	payload := []byte(pkt.Payload)
+	if pkt.Enc {
+		var s string
+		if json.Unmarshal(pkt.Payload, &s) == nil {
+			if raw, ok := rawBase64(s, base64.StdEncoding); ok && string(pkt.Payload) == `"`+s+`"` {
+				payload = raw
+				flags |= wireFlagRawEnc
+			}
+		}
+	}
+	code := wireTypeCodes[pkt.Type]
+
+	data := make([]byte, 0, wireHeaderSize+len(pkt.Payload)+len(pkt.Key)+len(pkt.Sig)+64)
+	data = append(data, wireMagic[0], wireMagic[1], version, flags, code, pkt.TTL)
+	data = binary.AppendVarint(data, pkt.Time)
+	fields := [][]byte{id, []byte(pkt.Source), []byte(pkt.Destination)}
+	if code == 0 {
+		fields = append(fields, []byte(pkt.Type))
+	}
+	fields = append(fields, payload, pkt.Key, pkt.Sig)
+	for _, field := range fields {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	return data, nil
+}
+
+// base64 string as bytes, only if it encodes back to same string
+func rawBase64(s string, enc *base64.Encoding) ([]byte, bool) {
+	raw, err := enc.DecodeString(s)
+	if err != nil || enc.EncodeToString(raw) != s {
+		return nil, false
+	}
+	return raw, true
+}
+
+// format is detected by first byte, so nodes accept both at any time
+func decodeWire(data []byte) (*packet, error) {
+	pkt := &packet{}
+	if len(data) < 2 || data[0] != wireMagic[0] || data[1] != wireMagic[1] {
+		err := json.Unmarshal(data, pkt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+		}
+		return pkt, checkForwardable(pkt)
+	}
+
+	if len(data) < wireHeaderSize {
+		return nil, fmt.Errorf("%w: short binary header", ErrMalformedPacket)
+	}
+	version, flags, code := data[2], data[3], data[4]
+	if version == 0 || version > wireVersion {
+		return nil, fmt.Errorf("%w: got %d, supported up to %d", ErrWireVersion, version, wireVersion)
+	}
+	if int(code) >= len(wireTypes) {
+		return nil, fmt.Errorf("%w: type code %d", ErrUnknownType, code)
+	}
+	pkt.TTL = data[5]
+	pkt.Ack = flags&wireFlagAck != 0
+	pkt.Enc = flags&wireFlagEnc != 0
+
+	rest := data[wireHeaderSize:]
+	time, k := binary.Varint(rest)
+	if k <= 0 {
+		return nil, fmt.Errorf("%w: bad time", ErrMalformedPacket)
+	}
+	pkt.Time = time
+	rest = rest[k:]
+	next := func() ([]byte, error) {
+		size, k := binary.Uvarint(rest)
+		if k <= 0 || size > uint64(len(rest)-k) {
+			return nil, fmt.Errorf("%w: bad field length", ErrMalformedPacket)
+		}
+		field := rest[k : k+int(size)]
+		rest = rest[k+int(size):]
+		return field, nil
+	}
+
+	fields := make([][]byte, 7) // id, source, destination, type, payload, key, sig
+	for i := range fields {
+		if i == 3 && code != 0 {
+			fields[i] = []byte(wireTypes[code])
+			continue
+		}
+		field, err := next()
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = field
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrMalformedPacket)
+	}
+
+	pkt.Id = string(fields[0])
+	if flags&wireFlagRawID != 0 {
+		pkt.Id = base64.RawStdEncoding.EncodeToString(fields[0])
+	}
+	pkt.Source = string(fields[1])
+	pkt.Destination = string(fields[2])
+	pkt.Type = string(fields[3])
+	if flags&wireFlagRawEnc != 0 {
+		pkt.Payload = json.RawMessage(`"` + base64.StdEncoding.EncodeToString(fields[4]) + `"`)
+	} else {
+		pkt.Payload = json.RawMessage(copySlice(fields[4]))
+	}
+	if len(fields[5]) > 0 {
+		pkt.Key = copySlice(fields[5])
+	}
+	if len(fields[6]) > 0 {
+		pkt.Sig = copySlice(fields[6])
+	}
+	return pkt, checkForwardable(pkt)
+}
+
+// relayed packet may be encoded in other format for next hop, it must not change,
+// otherwise signature breaks, json replaces invalid utf-8 and compacts payload
+func checkForwardable(pkt *packet) error {
+	for _, s := range []string{pkt.Id, pkt.Source, pkt.Destination, pkt.Type} {
+		if !utf8.ValidString(s) {
+			return fmt.Errorf("%w: invalid utf-8", ErrMalformedPacket)
+		}
+	}
+	if !json.Valid(pkt.Payload) {
+		return fmt.Errorf("%w: payload is not json", ErrMalformedPacket)
+	}
+	canonical, _ := json.Marshal(pkt.Payload)
+	if !bytes.Equal(canonical, pkt.Payload) {
+		return fmt.Errorf("%w: payload is not compact json", ErrMalformedPacket)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/pavelverigo/natalie/internal/bimap"
+)
+
+func testPacket() *packet {
+	return &packet{
+		Id:          randomID(16),
+		Source:      "a",
+		Destination: "b",
+		Type:        "chat",
+		Payload:     json.RawMessage(`{"Text":"hi"}`),
+		Ack:         true,
+		TTL:         7,
+		Time:        1700000000123,
+		Key:         bytes.Repeat([]byte{1}, 32),
+		Sig:         bytes.Repeat([]byte{2}, 64),
+	}
+}
+
+func samePacket(a *packet, b *packet) bool {
+	return a.Id == b.Id && a.Source == b.Source && a.Destination == b.Destination && a.Type == b.Type &&
+		bytes.Equal(a.Payload, b.Payload) && a.Ack == b.Ack && a.TTL == b.TTL && a.Time == b.Time &&
+		bytes.Equal(a.Key, b.Key) && bytes.Equal(a.Sig, b.Sig) && a.Enc == b.Enc
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	custom := testPacket()
+	custom.Type = "app/custom"
+	textID := testPacket()
+	textID.Id = "not base64 id!"
+	enc := testPacket()
+	enc.Enc = true
+	enc.Payload = json.RawMessage(`"AAECAwQFBgcICQ=="`)
+	encNotRaw := testPacket()
+	encNotRaw.Enc = true
+	encNotRaw.Payload = json.RawMessage(`"not base64"`)
+	empty := testPacket()
+	empty.Key, empty.Sig, empty.Ack, empty.Payload = nil, nil, false, json.RawMessage("null")
+
+	cases := map[string]*packet{
+		"builtin":      testPacket(),
+		"custom type":  custom,
+		"text id":      textID,
+		"raw enc":      enc,
+		"enc not raw":  encNotRaw,
+		"without keys": empty,
+	}
+	for name, pkt := range cases {
+		for _, version := range []uint8{0, wireVersion} {
+			data, err := encodeWire(pkt, version)
+			if err != nil {
+				t.Fatalf("%s v%d: %v", name, version, err)
+			}
+			got, err := decodeWire(data)
+			if err != nil {
+				t.Fatalf("%s v%d: %v", name, version, err)
+			}
+			if !samePacket(pkt, got) {
+				t.Fatalf("%s v%d: decoded %+v, want %+v", name, version, got, pkt)
+			}
+		}
+	}
+
+	// raw fields are sent as bytes
+	data, _ := encodeWire(enc, wireVersion)
+	if flags := data[3]; flags&wireFlagRawID == 0 || flags&wireFlagRawEnc == 0 {
+		t.Fatalf("flags %b, want raw id and raw enc", flags)
+	}
+	data, _ = encodeWire(encNotRaw, wireVersion)
+	if flags := data[3]; flags&wireFlagRawEnc != 0 {
+		t.Fatalf("flags %b, want payload as is", flags)
+	}
+	if data, _ := encodeWire(custom, wireVersion); data[4] != 0 || !bytes.Contains(data, []byte(custom.Type)) {
+		t.Fatal("custom type is not sent by name")
+	}
+}
+
+func TestDecodeWireErrors(t *testing.T) {
+	valid, err := encodeWire(testPacket(), wireVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := copySlice(valid)
+	newer[2] = wireVersion + 1
+	zero := copySlice(valid)
+	zero[2] = 0
+	badCode := copySlice(valid)
+	badCode[4] = byte(len(wireTypes))
+
+	// payload, which is not json, is replaced at same length
+	pkt := testPacket()
+	pkt.Payload = json.RawMessage(`{"x":1}`)
+	badPayload, _ := encodeWire(pkt, wireVersion)
+	i := bytes.Index(badPayload, pkt.Payload)
+	badPayload[i] = 0xff
+
+	cases := map[string]struct {
+		data []byte
+		want error
+	}{
+		"empty":        {nil, ErrMalformedPacket},
+		"garbage":      {[]byte{0xff, 0x00, 0x13}, ErrMalformedPacket},
+		"magic only":   {wireMagic[:], ErrMalformedPacket},
+		"short header": {valid[:wireHeaderSize-1], ErrMalformedPacket},
+		"truncated":    {valid[:len(valid)-1], ErrMalformedPacket},
+		"trailing":     {append(copySlice(valid), 0), ErrMalformedPacket},
+		"no fields":    {valid[:wireHeaderSize+1], ErrMalformedPacket},
+		"bad payload":  {badPayload, ErrMalformedPacket},
+		"newer":        {newer, ErrWireVersion},
+		"version 0":    {zero, ErrWireVersion},
+		"unknown code": {badCode, ErrUnknownType},
+	}
+	for name, c := range cases {
+		_, err := decodeWire(c.data)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: error %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+// packet, which can not be encoded for json neighbor, is not sent
+func TestSendPacketEncodeError(t *testing.T) {
+	n := &node{name2addr: bimap.New[string, string](0)}
+	pkt := testPacket()
+	pkt.Payload = json.RawMessage{0xff}
+	if err := n.sendPacket("10.0.0.1:1000", pkt); err == nil {
+		t.Fatal("invalid payload encoded as json")
+	}
+}
+
+func FuzzDecodeWire(f *testing.F) {
+	for _, version := range []uint8{0, wireVersion} {
+		pkt := testPacket()
+		data, _ := encodeWire(pkt, version)
+		f.Add(data)
+		pkt.Enc = true
+		pkt.Payload = json.RawMessage(`"AAECAwQFBgcICQ=="`)
+		pkt.Type = "app/custom"
+		data, _ = encodeWire(pkt, version)
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add(wireMagic[:])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt, err := decodeWire(data)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedPacket) && !errors.Is(err, ErrWireVersion) && !errors.Is(err, ErrUnknownType) {
+				t.Fatalf("untyped error %v", err)
+			}
+			return
+		}
+		// accepted packet can be forwarded in any format
+		for _, version := range []uint8{0, wireVersion} {
+			encoded, err := encodeWire(pkt, version)
+			if err != nil {
+				t.Fatalf("v%d: %v", version, err)
+			}
+			got, err := decodeWire(encoded)
+			if err != nil {
+				t.Fatalf("v%d: %v", version, err)
+			}
+			if !samePacket(pkt, got) {
+				t.Fatalf("v%d: decoded %+v, want %+v", version, got, pkt)
+			}
+		}
+	})
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"sync"
@@ -16,11 +19,14 @@ import (
 //go:embed static/*
 var static embed.FS
 
+const keyDir = "keys" // node keys by name, so restarted node keeps its name
+
 type server struct {
 	fsys fs.FS // TODO: custom fileserver with 404 page.
 
-	mu    sync.Mutex
-	nodes map[string]node.Node
+	mu     sync.Mutex
+	nodes  map[string]node.Node
+	adding map[string]bool // names reserved while node starts
 }
 
 func main() {
@@ -28,12 +34,17 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	err = os.MkdirAll(keyDir, 0700)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	s := server{
 		fsys: fsys,
 
-		mu:    sync.Mutex{},
-		nodes: make(map[string]node.Node),
+		mu:     sync.Mutex{},
+		nodes:  make(map[string]node.Node),
+		adding: make(map[string]bool),
 	}
 
 	http.HandleFunc("/api/nodes/", s.handleNodes)
@@ -70,6 +81,8 @@ func (s *server) handleNodes(w http.ResponseWriter, r *http.Request) {
 			s.handleNodeData(w, r, name)
 		case "POST":
 			s.handleNodeOp(w, r, name)
+		case "DELETE":
+			s.handleNodeStop(w, r, name)
 		default:
 			http.NotFound(w, r)
 		}
@@ -100,8 +113,9 @@ func (s *server) handleNodesList(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) handleNodesAdd(w http.ResponseWriter, r *http.Request) {
 	type addData struct {
-		Name string `json:"name"`
-		Port int    `json:"port"`
+		Name    string `json:"name"`
+		Port    int    `json:"port"`
+		PortMap bool   `json:"portmap"`
 	}
 
 	var add addData
@@ -111,7 +125,32 @@ func (s *server) handleNodesAdd(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	node, err := node.New(add.Name, add.Port, log.Default())
+	if !re.MatchString(add.Name) {
+		http.Error(w, "bad node name", http.StatusBadRequest)
+		return
+	}
+
+	// running node keeps its socket and key file, it must be stopped first
+	s.mu.Lock()
+	_, exists := s.nodes[add.Name]
+	if exists || s.adding[add.Name] {
+		s.mu.Unlock()
+		http.Error(w, "node already exists", http.StatusConflict)
+		return
+	}
+	s.adding[add.Name] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.adding, add.Name)
+		s.mu.Unlock()
+	}()
+
+	opts := []node.Option{node.WithIdentityFile(filepath.Join(keyDir, add.Name+".pem"))}
+	if add.PortMap {
+		opts = append(opts, node.WithPortMapping(""))
+	}
+	node, err := node.New(add.Name, add.Port, log.Default(), opts...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -126,6 +165,22 @@ func (s *server) handleNodesAdd(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 }
 
+func (s *server) handleNodeStop(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	n, ok := s.nodes[name]
+	delete(s.nodes, name)
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := n.Stop()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (s *server) handleNodeData(w http.ResponseWriter, r *http.Request, name string) {
 	s.mu.Lock()
 	n, ok := s.nodes[name]
@@ -136,20 +191,41 @@ func (s *server) handleNodeData(w http.ResponseWriter, r *http.Request, name str
 	}
 
 	type nodeData struct {
-		LocalAddr    string            `json:"local"`
-		Neighbors    map[string]string `json:"neigh"`
-		Addresses    []string          `json:"addr"`
-		RoutingTable map[string]string `json:"routing"`
-		Chat         []node.ChatData   `json:"chat"`
+		LocalAddr    string                         `json:"local"`
+		Key          string                         `json:"key"`
+		PeerKeys     map[string]string              `json:"keys"`
+		Neighbors    map[string]string              `json:"neigh"`
+		Addresses    []string                       `json:"addr"`
+		RoutingTable map[string]string              `json:"routing"`
+		Routes       map[string]node.RouteInfo      `json:"routes"`
+		Chat         []node.ChatData                `json:"chat"`
+		SentChat     []node.ChatData                `json:"sent"`
+		BadPackets   map[string]node.BadPacketStats `json:"bad"`
+		Stats        node.Stats                     `json:"stats"`
+		Traversals   map[string]node.TraversalInfo  `json:"traversals"`
+		NAT          node.NATInfo                   `json:"nat"`
+		PortMap      node.PortMapInfo               `json:"portmap"`
 	}
 
 	var data nodeData
 
 	data.LocalAddr = n.LocalAddr()
+	data.Key = base64.StdEncoding.EncodeToString(n.PublicKey())
+	data.PeerKeys = make(map[string]string)
+	for name, key := range n.PeerKeys() {
+		data.PeerKeys[name] = base64.StdEncoding.EncodeToString(key)
+	}
 	data.Neighbors = n.Neighbors()
 	data.Addresses = n.KnownAddr()
 	data.RoutingTable = n.RoutingTable()
+	data.Routes = n.Routes()
 	data.Chat = n.Chat()
+	data.SentChat = n.SentChat()
+	data.BadPackets = n.BadPackets()
+	data.Stats = n.Stats()
+	data.Traversals = n.Traversals()
+	data.NAT = n.NAT()
+	data.PortMap = n.PortMapping()
 
 	json, err := json.Marshal(&data)
 	if err != nil {
@@ -160,7 +236,7 @@ func (s *server) handleNodeData(w http.ResponseWriter, r *http.Request, name str
 
 func (s *server) handleNodeOp(w http.ResponseWriter, r *http.Request, name string) {
 	s.mu.Lock()
-	node, ok := s.nodes[name]
+	n, ok := s.nodes[name]
 	s.mu.Unlock()
 	if !ok {
 		http.NotFound(w, r)
@@ -182,15 +258,29 @@ func (s *server) handleNodeOp(w http.ResponseWriter, r *http.Request, name strin
 	switch op.Op {
 	case "nat":
 		type natData struct {
-			Dest  string `json:"dest"`
-			Local bool   `json:"local"`
+			Dest    string `json:"dest"`
+			Local   bool   `json:"local"`
+			Predict string `json:"predict"`
+			Range   int    `json:"range"`
+
+			Coordinated bool `json:"coordinated"`
 		}
 		var nat natData
 		err := json.Unmarshal(op.Data, &nat)
 		if err != nil {
 			panic(err)
 		}
-		node.TraversalHandshake(nat.Dest, nat.Local)
+		err = n.Traverse(nat.Dest, node.TraversalOptions{
+			Local:   nat.Local,
+			Predict: node.PortPrediction(nat.Predict),
+			Range:   nat.Range,
+
+			Coordinated: nat.Coordinated,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	case "direct":
 		type directData struct {
 			Addr string `json:"addr"`
@@ -200,7 +290,13 @@ func (s *server) handleNodeOp(w http.ResponseWriter, r *http.Request, name strin
 		if err != nil {
 			panic(err)
 		}
-		node.DirectHandshake(direct.Addr)
+		n.DirectHandshake(direct.Addr)
+	case "detectnat":
+		err := n.DetectNAT()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	case "chat":
 		type chatData struct {
 			Dest string `json:"dest"`
@@ -211,7 +307,11 @@ func (s *server) handleNodeOp(w http.ResponseWriter, r *http.Request, name strin
 		if err != nil {
 			panic(err)
 		}
-		node.SendChat(chat.Dest, chat.Text)
+		_, err = n.SendChat(chat.Dest, chat.Text)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	default:
 		log.Fatalln("unknown", op.Op)
 	}
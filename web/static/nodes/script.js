@@ -9,6 +9,9 @@ const directButton = document.getElementById("direct-button")
 const natInput = document.getElementById("nat-input");
 const natButton = document.getElementById("nat-button")
 const natCheckbox = document.getElementById("nat-checkbox")
+const predictSelect = document.getElementById("predict-select")
+const coordinatedCheckbox = document.getElementById("coordinated-checkbox")
+const detectNatButton = document.getElementById("detect-nat-button")
 
 const destInput = document.getElementById("dest-input");
 const textInput = document.getElementById("text-input")
@@ -18,11 +21,19 @@ const refreshP = document.getElementById("refresh-p");
 const refreshButton = document.getElementById("refresh-button");
 
 const localP = document.getElementById("local-p")
+const keyP = document.getElementById("key-p")
+const portMapP = document.getElementById("portmap-p")
+const natP = document.getElementById("nat-p")
 
 const neighborList = document.getElementById("neighbor-list")
 const addrList = document.getElementById("addr-list");
 const routingList = document.getElementById("routing-list");
+const keyList = document.getElementById("key-list");
 const chatList = document.getElementById("chat-list")
+const badList = document.getElementById("bad-list")
+const statsList = document.getElementById("stats-list")
+const traversalList = document.getElementById("traversal-list")
+const sentList = document.getElementById("sent-list")
 
 function appendToNodeList(text, list) {
   let li = document.createElement("li");
@@ -33,31 +44,79 @@ function appendToNodeList(text, list) {
   list.appendChild(li);
 }
 
+// ipv6 addresses are in brackets, like [::1]:4000
+function family(addr) {
+  if (addr.startsWith("[::]:")) {
+    return "IPv4 and IPv6"
+  }
+  return addr.startsWith("[") ? "IPv6" : "IPv4"
+}
+
 const api = `/api/nodes/${node}`
 
 function fetchNodeData() {
   fetch(api).then(resp => resp.json()).then(data => {
-    localP.innerText = `Local addr: ${data.local}`
+    localP.innerText = `Local addr: ${data.local} (${family(data.local)})`
+    keyP.innerText = `Public key: ${data.key}`
+    const mapped = Object.entries(data.nat.mapped || {}).map(([k, v]) => `${k} sees ${v}`).join(", ")
+    natP.innerText = `NAT type: ${data.nat.type} | ${mapped} | checked at ${data.nat.checked}`
+    const pm = data.portmap
+    portMapP.innerText = pm.external ? `Port mapping: ${pm.external} by ${pm.protocol} on ${pm.gateway} | expires at ${pm.expires}` : `Port mapping: ${pm.error || "none"}`
 
     neighborList.innerHTML = ""
     for (const key in data.neigh) {
-      appendToNodeList(`name: ${key}, addr: ${data.neigh[key]}`, neighborList)
+      appendToNodeList(`name: ${key}, addr: ${data.neigh[key]} (${family(data.neigh[key])})`, neighborList)
     }
 
     addrList.innerHTML = ""
-    for (const addr of data.addr) {
-      appendToNodeList(`${addr}`, addrList)
+    for (const fam of ["IPv6", "IPv4"]) {
+      for (const addr of data.addr.filter(a => family(a) === fam)) {
+        appendToNodeList(`${fam}: ${addr}`, addrList)
+      }
+    }
+
+    keyList.innerHTML = ""
+    for (const key in data.keys) {
+      appendToNodeList(`${key}: ${data.keys[key]}`, keyList)
     }
 
     routingList.innerHTML = ""
-    for (const key in data.routing) {
-      appendToNodeList(`for ${key}, go to ${data.routing[key]}`, routingList)
+    for (const key in data.routes) {
+      const route = data.routes[key]
+      appendToNodeList(`for ${key}, go to ${route.next_hop} | backups: ${route.backups.join(", ")} | path: ${route.path.join(" > ")} | hops: ${route.hops} | cost: ${route.cost} ms | state: ${route.epoch}/${route.seq} | changed at ${route.changed}`, routingList)
+    }
+
+    traversalList.innerHTML = ""
+    for (const key in data.traversals) {
+      const t = data.traversals[key]
+      const relay = t.relay ? ` through ${t.relay}` : ""
+      const cand = c => c.type === "relay" ? `relay ${c.relay}` : `${c.type} ${c.addr}`
+      const pair = t.pair ? ` | pair: ${cand(t.pair.local)} <-> ${cand(t.pair.remote)}` : ""
+      const rtt = t.relayRtt ? ` | relay rtt: ${(t.relayRtt / 1e6).toFixed(1)}ms` : ""
+      const candidates = `${rtt} | candidates: ${(t.localCandidates || []).length} local, ${(t.remoteCandidates || []).length} remote`
+      appendToNodeList(`${key}: ${t.state}${relay}${pair}${candidates} | attempts: ${t.attempts} | updated at ${t.updated}`, traversalList)
+    }
+
+    statsList.innerHTML = ""
+    for (const key in data.stats) {
+      appendToNodeList(`${key}: ${data.stats[key]}`, statsList)
+    }
+
+    badList.innerHTML = ""
+    for (const key in data.bad) {
+      const bad = data.bad[key]
+      appendToNodeList(`from ${key}, count: ${bad.count}, last: ${bad.last_error}, banned until: ${bad.banned_until}`, badList)
     }
 
     chatList.innerHTML = ""
     for (const msg of data.chat) {
       appendToNodeList(`${msg.text} | from ${msg.src} | at ${msg.time}`, chatList)
     }
+
+    sentList.innerHTML = ""
+    for (const msg of data.sent) {
+      appendToNodeList(`${msg.text} | to ${msg.dest} | at ${msg.time} | ${msg.status}`, sentList)
+    }
   });
 }
 
@@ -96,7 +155,14 @@ directButton.onclick = () => {
 natButton.onclick = () => {
   let dest = natInput.value
   let local = natCheckbox.checked
-  postData(api, { op: "nat", data: { dest: dest, local: local }});
+  let predict = predictSelect.value
+  let coordinated = coordinatedCheckbox.checked
+  postData(api, { op: "nat", data: { dest: dest, local: local, predict: predict, coordinated: coordinated }});
+  fetchNodeList();
+}
+
+detectNatButton.onclick = () => {
+  postData(api, { op: "detectnat", data: {}});
   fetchNodeList();
 }
 
@@ -1,5 +1,6 @@
 const nameInput = document.getElementById("name-input");
 const portInput = document.getElementById("port-input");
+const portMapCheckbox = document.getElementById("portmap-checkbox");
 const addButton = document.getElementById("add-button");
 
 const refreshP = document.getElementById("refresh-p");
@@ -19,12 +20,15 @@ function appendToNodeList(name) {
   a.href = `/nodes/?name=${name}`;
   a.appendChild(nameText);
 
-  // let stop = document.createElement("button");
-  // let stopText = document.createTextNode("Stop");
-  // stop.appendChild(stopText)
+  let stop = document.createElement("button");
+  let stopText = document.createTextNode("Stop");
+  stop.appendChild(stopText)
+  stop.onclick = () => {
+    fetch(`/api/nodes/${name}`, { method: 'DELETE' }).then(() => fetchNodeList());
+  }
 
   li.appendChild(a);
-  // li.appendChild(stop);
+  li.appendChild(stop);
   nodeList.appendChild(li);
 }
 
@@ -40,8 +44,9 @@ function fetchNodeList() {
 addButton.onclick = () => {
   let name = nameInput.value;
   let port = parseInt(portInput.value);
+  let portmap = portMapCheckbox.checked;
   if (onlyLettersAndNumbers(name)) {
-    postData('/api/nodes/', { name: name, port: port });
+    postData('/api/nodes/', { name: name, port: port, portmap: portmap });
     fetchNodeList();
   } else {
     console.log(`illegal name ${name}, use only letters and digits`)